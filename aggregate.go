@@ -0,0 +1,159 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/huandu/go-sqlbuilder"
+)
+
+// Count returns the number of rows matched by the query, the number of
+// distinct rows of a DISTINCT query, or the number of groups of a grouped
+// query. ORDER BY, LIMIT and OFFSET are ignored.
+func (qb *QueryBuilder) Count(ctx context.Context) (int64, error) {
+	qb = qb.private()
+	var count int64
+	query, args := qb.countQuery()
+	err := qb.get(ctx, &count, query, args)
+	return count, err
+}
+
+// Sum returns the sum of the column over the rows matched by the query, or
+// 0 if there are none. On a grouped query, the column must be one of the
+// selected columns and is summed over the groups.
+func (qb *QueryBuilder) Sum(ctx context.Context, column string) (float64, error) {
+	qb = qb.private()
+	return qb.aggregateFloat(ctx, "SUM", column)
+}
+
+// Avg returns the average of the column over the rows matched by the query,
+// or 0 if there are none. On a grouped query, the column must be one of the
+// selected columns and is averaged over the groups.
+func (qb *QueryBuilder) Avg(ctx context.Context, column string) (float64, error) {
+	qb = qb.private()
+	if qb.conn.Config.Driver == DialectMsSQL {
+		column = floatColumn(quoteColumn(qb.Flavor(), column))
+	}
+	return qb.aggregateFloat(ctx, "AVG", column)
+}
+
+// Min scans the smallest value of the column over the rows matched by the
+// query into dest. The value is NULL if there are no rows, so dest should
+// be nullable, like a sql.NullInt64 or a pointer, if that can happen.
+func (qb *QueryBuilder) Min(ctx context.Context, column string, dest any) error {
+	qb = qb.private()
+	query, args := qb.aggregateQuery("MIN", column)
+	return qb.get(ctx, dest, query, args)
+}
+
+// Max scans the largest value of the column over the rows matched by the
+// query into dest. The value is NULL if there are no rows, so dest should
+// be nullable, like a sql.NullInt64 or a pointer, if that can happen.
+func (qb *QueryBuilder) Max(ctx context.Context, column string, dest any) error {
+	qb = qb.private()
+	query, args := qb.aggregateQuery("MAX", column)
+	return qb.get(ctx, dest, query, args)
+}
+
+// Exists returns true if the query matches at least one row
+func (qb *QueryBuilder) Exists(ctx context.Context) (bool, error) {
+	qb = qb.private()
+	qb.ensureSelect()
+
+	first := *qb
+	first.orderBy, first.limit, first.offset = nil, 1, -1
+
+	var one int
+	query, args := first.selectBuilder([]string{"1"}, true).Build()
+	err := qb.get(ctx, &one, query, args)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Pluck scans the values of a single column of the rows matched by the
+// query into dest, which must be a pointer to a slice. ORDER BY, LIMIT and
+// OFFSET are kept.
+//
+//	var emails []string
+//	err := db.Query().Table("users").Where(db.EQ("active", true)).Pluck(ctx, "email", &emails)
+func (qb *QueryBuilder) Pluck(ctx context.Context, column string, dest any) error {
+	qb = qb.private()
+	qb.ensureSelect()
+
+	query, args := qb.selectBuilder([]string{quoteColumn(qb.Flavor(), column)}, true).Build()
+	return qb.selectInto(ctx, dest, query, args)
+}
+
+// Value scans the column of the first row matched by the query into dest.
+// It returns sql.ErrNoRows if there is no such row.
+func (qb *QueryBuilder) Value(ctx context.Context, column string, dest any) error {
+	qb = qb.private()
+	qb.ensureSelect()
+
+	first := *qb
+	first.limit = 1
+
+	query, args := first.selectBuilder([]string{quoteColumn(qb.Flavor(), column)}, true).Build()
+	return qb.get(ctx, dest, query, args)
+}
+
+// floatColumn casts the quoted column to a float, for SQL Server, which
+// averages integers as integers
+func floatColumn(column string) string {
+	return "CAST(" + column + " AS FLOAT)"
+}
+
+// aggregateFloat runs an aggregate returning a number, NULL being read as 0
+func (qb *QueryBuilder) aggregateFloat(ctx context.Context, fn, column string) (float64, error) {
+	var value sql.NullFloat64
+	query, args := qb.aggregateQuery(fn, column)
+	err := qb.get(ctx, &value, query, args)
+	return value.Float64, err
+}
+
+// aggregateQuery builds a query computing the aggregate function of the
+// column over the rows matched by the SELECT query, keeping its JOIN and
+// WHERE clauses but not its ORDER BY, LIMIT and OFFSET. Grouped and DISTINCT
+// queries are aggregated through a derived table of their selected columns,
+// and combined queries through the derived table of their rows.
+func (qb *QueryBuilder) aggregateQuery(fn, column string) (string, []any) {
+	qb.ensureSelect()
+
+	expr := fmt.Sprintf("%s(%s)", fn, quoteColumn(qb.Flavor(), column))
+	if len(qb.setOps) > 0 {
+		return qb.selectBuilder([]string{expr}, false).Build()
+	}
+
+	var columns []string
+	if !qb.hasSelection() {
+		columns = []string{"*"}
+	}
+	inner := qb.withoutCTEs().selectBuilder(columns, false)
+	if !qb.grouped && !isDistinct(inner) {
+		return qb.selectBuilder([]string{expr}, false).Build()
+	}
+
+	sb := GetFlavorForDialect(qb.conn.Config.Driver).NewSelectBuilder()
+	qb.withCTEs(sb)
+	return sb.Select(expr).From(sb.BuilderAs(inner, "t")).Build()
+}
+
+// isDistinct returns true if the SELECT query selects distinct rows, either
+// with a DISTINCT column like "DISTINCT name" or the Distinct method of the
+// underlying builder.
+func isDistinct(sb sqlbuilder.Builder) bool {
+	query, _ := sb.Build()
+	return strings.HasPrefix(strings.ToUpper(query), "SELECT DISTINCT ")
+}
+
+// ensureSelect turns the query into a SELECT query if it is not one
+func (qb *QueryBuilder) ensureSelect() {
+	if _, ok := qb.builder.(*BuilderSelect); !ok {
+		qb.reset("SELECT", SelectBuilder(qb.conn.ConnName))
+	}
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// maxPlaceholders is the maximum number of bound parameters of a statement per dialect
+var maxPlaceholders = map[string]int{
+	DialectSQLite: 999, // SQLITE_MAX_VARIABLE_NUMBER before SQLite 3.32
+	DialectMySQL:  65535,
+	DialectPgSQL:  65535,
+	DialectMsSQL:  2098, // 2100 parameters, minus the two taken by sp_executesql
+}
+
+// maxBatchRows is the maximum number of rows of a VALUES list per dialect
+var maxBatchRows = map[string]int{
+	DialectMsSQL: 1000,
+}
+
+// defaultMaxBatchBytes is the default size budget of the values of a batch
+// statement on MySQL, below the 4MB max_allowed_packet of older servers.
+const defaultMaxBatchBytes = 4 << 20
+
+// BatchOptions configures InsertBatch
+type BatchOptions struct {
+	// ChunkSize is the maximum number of rows per INSERT statement.
+	// Zero fits as many rows as the placeholder and row limits of the dialect allow.
+	ChunkSize int
+	// MaxBytes is the maximum estimated size of the values of a chunk.
+	// It defaults to 4MB on MySQL, to stay below max_allowed_packet, and is
+	// unlimited on the other dialects.
+	MaxBytes int
+	// Transaction runs all the chunks in a single transaction, so that a
+	// failing chunk rolls back the ones inserted before it.
+	Transaction bool
+}
+
+// BatchResult is the outcome of InsertBatch
+type BatchResult struct {
+	// RowsAffected is the number of rows inserted by the committed chunks
+	RowsAffected int64
+	// Chunks is the number of chunks that were run successfully
+	Chunks int
+}
+
+// BatchError reports the chunk of a batch insert that failed
+type BatchError struct {
+	// Chunk is the index of the failed chunk
+	Chunk int
+	// Offset is the index of the first row of the failed chunk
+	Offset int
+	// Rows is the number of rows in the failed chunk
+	Rows int
+	Err  error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch insert chunk %d (rows %d to %d): %v", e.Chunk, e.Offset, e.Offset+e.Rows-1, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// InsertBatch inserts the rows into the table of the QueryBuilder, split in
+// as many INSERT statements as needed to stay within the placeholder limit
+// of the dialect. A conflict clause set with OnConflict applies to every chunk.
+//
+// When a chunk fails, the returned error is a *BatchError and the result
+// holds what was inserted before it, which is nothing if opts.Transaction is set.
+func (qb *QueryBuilder) InsertBatch(ctx context.Context, columns []string, rows [][]any, opts BatchOptions) (*BatchResult, error) {
+	qb = qb.private()
+	chunks, err := splitBatch(qb.conn.Config.Driver, columns, rows, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BatchResult{}
+	if !opts.Transaction {
+		err := qb.insertChunks(ctx, qb.tx, columns, chunks, result)
+		return result, err
+	}
+
+	err = qb.Transaction(ctx, func(txQB *QueryBuilder) error {
+		return qb.insertChunks(ctx, txQB.tx, columns, chunks, result)
+	})
+	if err != nil {
+		result.RowsAffected, result.Chunks = 0, 0
+	}
+	return result, err
+}
+
+// insertChunks runs an INSERT statement per chunk, in the given transaction if any
+func (qb *QueryBuilder) insertChunks(ctx context.Context, tx *Tx, columns []string, chunks [][][]any, result *BatchResult) error {
+	offset := 0
+	for i, chunk := range chunks {
+		chunkQB := &QueryBuilder{
+			conn:      qb.conn,
+			tableName: qb.tableName,
+			debug:     qb.debug,
+			limit:     -1,
+			offset:    -1,
+			upsert:    qb.upsert,
+			tx:        tx,
+		}
+
+		res, err := chunkQB.Insert(columns, chunk).Exec(ctx)
+		if err != nil {
+			return &BatchError{Chunk: i, Offset: offset, Rows: len(chunk), Err: err}
+		}
+		if affected, err := res.RowsAffected(); err == nil {
+			result.RowsAffected += affected
+		}
+		result.Chunks++
+		offset += len(chunk)
+	}
+	return nil
+}
+
+// splitBatch splits the rows in chunks fitting the limits of the dialect
+func splitBatch(dialect string, columns []string, rows [][]any, opts BatchOptions) ([][][]any, error) {
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("batch insert requires columns")
+	}
+
+	maxRows := len(rows)
+	if limit, ok := maxPlaceholders[dialect]; ok {
+		maxRows = limit / len(columns)
+		if maxRows == 0 {
+			return nil, fmt.Errorf("%d columns exceed the %d placeholders allowed by %s", len(columns), limit, dialect)
+		}
+	}
+	if limit, ok := maxBatchRows[dialect]; ok && limit < maxRows {
+		maxRows = limit
+	}
+	if opts.ChunkSize > 0 && opts.ChunkSize < maxRows {
+		maxRows = opts.ChunkSize
+	}
+
+	maxBytes := opts.MaxBytes
+	if maxBytes == 0 && dialect == DialectMySQL {
+		maxBytes = defaultMaxBatchBytes
+	}
+
+	var chunks [][][]any
+	start, size := 0, 0
+	for i, row := range rows {
+		if len(row) != len(columns) {
+			return nil, fmt.Errorf("row %d has %d values for %d columns", i, len(row), len(columns))
+		}
+
+		rowSize := 0
+		if maxBytes > 0 {
+			rowSize = estimateSize(row)
+		}
+		if i > start && (i-start == maxRows || (maxBytes > 0 && size+rowSize > maxBytes)) {
+			chunks = append(chunks, rows[start:i])
+			start, size = i, 0
+		}
+		size += rowSize
+	}
+	if start < len(rows) {
+		chunks = append(chunks, rows[start:])
+	}
+
+	return chunks, nil
+}
+
+// estimateSize estimates the number of bytes the values take in a statement
+func estimateSize(row []any) int {
+	size := 0
+	for _, value := range row {
+		switch v := value.(type) {
+		case string:
+			size += len(v) + 2
+		case []byte:
+			size += 2*len(v) + 3
+		default:
+			size += 8
+		}
+		size += 2 // separator
+	}
+	return size
+}
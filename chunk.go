@@ -0,0 +1,167 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ChunkOptions configures Chunk and ChunkByID
+type ChunkOptions struct {
+	// Transaction runs every chunk, the query reading it and the function
+	// processing it, in its own transaction. The context passed to the
+	// function carries the transaction, so that the queries run with it join
+	// it. A failing chunk rolls back only its own changes.
+	Transaction bool
+}
+
+// Chunk runs the query page by page, with Page, and calls fn with every
+// page of at most size rows scanned into T. It stops at the first error
+// returned by fn, which is returned unless it is ErrStop.
+//
+// The query should be ordered for the pages to be stable. As pages are read
+// by offset, rows inserted or deleted by fn shift the pages that follow; use
+// ChunkByID when fn changes the rows it walks.
+func Chunk[T any](ctx context.Context, qb *QueryBuilder, size int, fn func(ctx context.Context, chunk []T) error, opts ...ChunkOptions) error {
+	if size < 1 {
+		return fmt.Errorf("chunk size must be positive, got %d", size)
+	}
+	qb = qb.private()
+	if qb.builder == nil {
+		qb.builder = SelectBuilder(qb.conn.ConnName)
+	}
+
+	limit, offset := qb.limit, qb.offset
+	defer func() { qb.limit, qb.offset = limit, offset }()
+
+	page := 1
+	return walkChunks(ctx, qb, size, chunkOptions(opts), func(ctx context.Context) ([]T, error) {
+		query, args := qb.Page(page, size).Build()
+		page++
+		return fetchChunk[T](ctx, qb, query, args)
+	}, fn)
+}
+
+// ChunkByID runs the query in chunks of at most size rows ordered by column,
+// which must be a unique key such as the primary key, and calls fn with every
+// chunk scanned into T. Every chunk starts after the last key of the previous
+// one rather than at an offset, so fn may update or delete the rows it gets.
+// It stops at the first error returned by fn, which is returned unless it is
+// ErrStop.
+//
+// The column must be selected by the query, and T must hold it: a struct with
+// a matching db tag, a map, or the key itself. The ORDER BY, LIMIT and OFFSET
+// of the query are ignored.
+func ChunkByID[T any](ctx context.Context, qb *QueryBuilder, size int, column string, fn func(ctx context.Context, chunk []T) error, opts ...ChunkOptions) error {
+	if size < 1 {
+		return fmt.Errorf("chunk size must be positive, got %d", size)
+	}
+	qb = qb.private()
+	if qb.builder == nil {
+		qb.builder = SelectBuilder(qb.conn.ConnName)
+	}
+
+	name := unqualified(column)
+	var last any
+	return walkChunks(ctx, qb, size, chunkOptions(opts), func(ctx context.Context) ([]T, error) {
+		query, args := qb.keysetChunkQuery(name, last, size)
+		rows, err := fetchChunk[T](ctx, qb, query, args)
+		if err != nil || len(rows) == 0 {
+			return rows, err
+		}
+
+		row := reflect.ValueOf(rows[len(rows)-1])
+		if field := qb.rowField(row, name); field.IsValid() {
+			last = field.Interface()
+		} else if row.Kind() != reflect.Struct && row.Kind() != reflect.Map {
+			last = row.Interface()
+		} else {
+			return nil, fmt.Errorf("chunk column %s is not in the result", name)
+		}
+		return rows, nil
+	}, fn)
+}
+
+// keysetChunkQuery builds the query of the chunk following the given key, the
+// SELECT query being wrapped in a derived table so that it stays untouched.
+// A nil key selects the first chunk.
+func (qb *QueryBuilder) keysetChunkQuery(column string, after any, size int) (string, []any) {
+	var columns []string
+	if !qb.hasSelection() {
+		columns = []string{"*"}
+	}
+	inner := qb.withoutCTEs().selectBuilder(columns, false)
+
+	sb := GetFlavorForDialect(qb.conn.Config.Driver).NewSelectBuilder()
+	qb.withCTEs(sb)
+	sb.Select("*").From(sb.BuilderAs(inner, "chunk"))
+	column = quoteColumn(sb.Flavor(), column)
+	if after != nil {
+		sb.Where(sb.GreaterThan(column, after))
+	}
+	return sb.OrderBy(column).Limit(size).Build()
+}
+
+// chunkOptions returns the options passed to Chunk or ChunkByID, if any
+func chunkOptions(opts []ChunkOptions) ChunkOptions {
+	if len(opts) > 0 {
+		return opts[0]
+	}
+	return ChunkOptions{}
+}
+
+// walkChunks reads chunks with next and passes them to fn until a chunk is
+// shorter than size, next or fn fails, or fn returns ErrStop. The chunk
+// ending with ErrStop is committed.
+func walkChunks[T any](ctx context.Context, qb *QueryBuilder, size int, opts ChunkOptions, next func(context.Context) ([]T, error), fn func(context.Context, []T) error) error {
+	stopped := false
+	process := func(ctx context.Context) (int, error) {
+		rows, err := next(ctx)
+		if err != nil || len(rows) == 0 {
+			return 0, err
+		}
+		if err := fn(ctx, rows); err != nil {
+			if !errors.Is(err, ErrStop) {
+				return 0, err
+			}
+			stopped = true
+		}
+		return len(rows), nil
+	}
+
+	for {
+		var n int
+		var err error
+		if opts.Transaction {
+			err = qb.Transaction(ctx, func(txQB *QueryBuilder) error {
+				n, err = process(WithTx(ctx, txQB.tx))
+				return err
+			})
+		} else {
+			n, err = process(ctx)
+		}
+		if err != nil || stopped || n < size {
+			return err
+		}
+	}
+}
+
+// fetchChunk runs a built query and scans all the rows into a slice of T
+func fetchChunk[T any](ctx context.Context, qb *QueryBuilder, query string, args []any) ([]T, error) {
+	rows, err := qb.queryx(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunk []T
+	for rows.Next() {
+		var value T
+		if err := scanRow(rows.Rows, &value); err != nil {
+			return nil, err
+		}
+		chunk = append(chunk, value)
+	}
+	return chunk, rows.Err()
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/huandu/go-sqlbuilder"
+)
+
+// ErrCloneNotSupported is returned by the queries of a copy made by Clone of
+// a QueryBuilder whose underlying builder cannot be copied.
+var ErrCloneNotSupported = errors.New("query built on a builder that cannot be copied cannot be cloned")
+
+// Clone returns a deep copy of the QueryBuilder. Conditions, joins, groups,
+// order, limit and every other clause can be added to the copy without
+// changing the original, and the other way around:
+//
+//	active := db.Query().Table("users").Select("*").Where(db.EQ("active", true))
+//	admins := active.Clone().Where(db.EQ("role", "admin"))
+//
+// The clauses added through the QueryBuilder are replayed on a new
+// underlying builder, so their conditions are evaluated again. A builder set
+// with SetBuilder, returned by AsSelect and the like, or holding conditions
+// rendered on the builder returned by GetBuilder cannot be copied: the copy
+// is then left without it and its queries fail with ErrCloneNotSupported.
+func (qb *QueryBuilder) Clone() *QueryBuilder {
+	c := *qb
+	c.clauses = slices.Clip(qb.clauses)
+	c.selectColumns = slices.Clone(qb.selectColumns)
+	c.insertColumns = slices.Clone(qb.insertColumns)
+	c.orderBy = slices.Clone(qb.orderBy)
+	c.returning = slices.Clone(qb.returning)
+	c.ctes = slices.Clone(qb.ctes)
+	c.setOps = slices.Clone(qb.setOps)
+	c.windows = slices.Clone(qb.windows)
+	c.updatables = maps.Clone(qb.updatables)
+
+	if qb.insertValues != nil {
+		c.insertValues = make([][]any, len(qb.insertValues))
+		for i, row := range qb.insertValues {
+			c.insertValues[i] = slices.Clone(row)
+		}
+	}
+	if qb.upsert != nil {
+		c.upsert = &upsert{
+			keys:    slices.Clone(qb.upsert.keys),
+			update:  qb.upsert.update,
+			columns: slices.Clone(qb.upsert.columns),
+		}
+	}
+
+	if qb.builder != nil {
+		c.builder = qb.replay()
+		if qb.rawBuilder || qb.unrecorded(c.builder) {
+			c.err = ErrCloneNotSupported
+		}
+	}
+	return &c
+}
+
+// Immutable returns an immutable copy of the QueryBuilder. Every method
+// called on an immutable QueryBuilder leaves it untouched: chained methods
+// return a changed copy, which is immutable too, and queries are built and
+// run from a private copy. An immutable base query can thus be shared by
+// goroutines and extended by each of them:
+//
+//	var activeUsers = db.Query().Table("users").Select("*").Where(db.EQ("active", true)).Immutable()
+//
+//	err := activeUsers.Where(db.EQ("id", id)).Scan(ctx, &user)
+func (qb *QueryBuilder) Immutable() *QueryBuilder {
+	c := qb.Clone()
+	c.immutable = true
+	return c
+}
+
+// mutable returns the QueryBuilder a chained method changes: the QueryBuilder
+// itself, or a copy of it if it is immutable.
+func (qb *QueryBuilder) mutable() *QueryBuilder {
+	if !qb.immutable {
+		return qb
+	}
+	return qb.Clone()
+}
+
+// private returns the QueryBuilder a query is built and run from: the
+// QueryBuilder itself, or a mutable copy of it if it is immutable.
+func (qb *QueryBuilder) private() *QueryBuilder {
+	if !qb.immutable {
+		return qb
+	}
+	c := qb.Clone()
+	c.immutable = false
+	return c
+}
+
+// scratch returns a mutable copy of the QueryBuilder, for methods changing
+// the query they run, which must leave the query of the caller untouched
+// whether it is immutable or not.
+func (qb *QueryBuilder) scratch() *QueryBuilder {
+	c := qb.Clone()
+	c.immutable = false
+	return c
+}
+
+// freshBuilder returns a new underlying builder with the clauses of the
+// query replayed on it, for Build to add the clauses it renders without
+// adding to the arguments of the builder of the query. A builder which
+// cannot be replayed is returned as is and has to be copied by the caller.
+func (qb *QueryBuilder) freshBuilder() Builder {
+	if qb.rawBuilder {
+		return qb.builder
+	}
+	b := qb.replay()
+	if qb.unrecorded(b) {
+		return qb.builder
+	}
+	return b
+}
+
+// replay returns a new underlying builder with the clauses of the query
+// applied to it
+func (qb *QueryBuilder) replay() Builder {
+	b := qb.newBuilderLike(qb.builder)
+	for _, apply := range qb.clauses {
+		apply(b)
+	}
+	return b
+}
+
+// unrecorded returns true if the builder of the query holds arguments that
+// the replayed builder does not, which happens when conditions are rendered
+// on the builder returned by GetBuilder. Their placeholders refer to the
+// arguments of that builder, so the query can only be built from it.
+func (qb *QueryBuilder) unrecorded(replayed Builder) bool {
+	args, replayedArgs := builderArgs(qb.builder), builderArgs(replayed)
+	if args == nil || replayedArgs == nil {
+		return false
+	}
+	// The first argument of both builders is their WHERE clause
+	n := 1
+	for hasArg(replayedArgs, n) {
+		n++
+	}
+	return hasArg(args, n)
+}
+
+// builderArgs returns the arguments of a builder taking conditions, or nil
+func builderArgs(b Builder) *sqlbuilder.Args {
+	switch b := b.(type) {
+	case *BuilderSelect:
+		return b.Cond.Args
+	case *BuilderUpdate:
+		return b.Cond.Args
+	case *BuilderDelete:
+		return b.Cond.Args
+	default:
+		return nil
+	}
+}
+
+// hasArg returns true if args holds an argument at index i
+func hasArg(args *sqlbuilder.Args, i int) bool {
+	query, _ := args.Compile("$" + strconv.Itoa(i))
+	return !strings.HasPrefix(query, "/* INVALID ARG")
+}
+
+// addClause applies a clause to the underlying builder and records it, so
+// that Clone can replay it on the builder of the copy.
+func (qb *QueryBuilder) addClause(apply func(Builder)) {
+	apply(qb.builder)
+	qb.clauses = append(qb.clauses, apply)
+}
+
+// newBuilderLike returns a new empty builder of the same kind as b
+func (qb *QueryBuilder) newBuilderLike(b Builder) Builder {
+	flavor := getBuilderForDialect(qb.conn.Config.Driver)
+	switch b.(type) {
+	case nil:
+		return nil
+	case *BuilderSelect:
+		return &BuilderSelect{flavor.NewSelectBuilder()}
+	case *BuilderInsert:
+		return &BuilderInsert{flavor.NewInsertBuilder()}
+	case *BuilderUpdate:
+		return &BuilderUpdate{flavor.NewUpdateBuilder()}
+	case *BuilderDelete:
+		return &BuilderDelete{flavor.NewDeleteBuilder()}
+	default:
+		return b
+	}
+}
@@ -1,12 +1,14 @@
 package db
 
 // ConditionFunc is a function that returns a string representing a condition.
-// It proxies the calls to the original condition functions.
+// It proxies the calls to the original condition functions, quoting the
+// field if it is a reserved word.
 type ConditionFunc func(builder Builder) string
 
 // Equal is used to construct the expression "field = value".
 func Equal(field string, value interface{}) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).Equal(field, value)
@@ -33,6 +35,7 @@ func EQ(field string, value interface{}) ConditionFunc {
 // NotEqual is used to construct the expression "field <> value".
 func NotEqual(field string, value interface{}) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).NotEqual(field, value)
@@ -59,6 +62,7 @@ func NEQ(field string, value interface{}) ConditionFunc {
 // GreaterThan is used to construct the expression "field > value".
 func GreaterThan(field string, value interface{}) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).GreaterThan(field, value)
@@ -85,6 +89,7 @@ func GT(field string, value interface{}) ConditionFunc {
 // GreaterEqualThan is used to construct the expression "field >= value".
 func GreaterEqualThan(field string, value interface{}) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).GreaterEqualThan(field, value)
@@ -111,6 +116,7 @@ func GTE(field string, value interface{}) ConditionFunc {
 // LessThan is used to construct the expression "field < value".
 func LessThan(field string, value interface{}) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).LessThan(field, value)
@@ -137,6 +143,7 @@ func LT(field string, value interface{}) ConditionFunc {
 // LessEqualThan is used to construct the expression "field <= value".
 func LessEqualThan(field string, value interface{}) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).LessEqualThan(field, value)
@@ -161,8 +168,11 @@ func LTE(field string, value interface{}) ConditionFunc {
 }
 
 // In is used to construct the expression "field IN (value...)".
+// A *QueryBuilder value is used as a subquery.
 func In(field string, values ...interface{}) ConditionFunc {
+	values = subqueries(values)
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).In(field, values...)
@@ -177,8 +187,11 @@ func In(field string, values ...interface{}) ConditionFunc {
 }
 
 // NotIn is used to construct the expression "field NOT IN (value...)".
+// A *QueryBuilder value is used as a subquery.
 func NotIn(field string, values ...interface{}) ConditionFunc {
+	values = subqueries(values)
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).NotIn(field, values...)
@@ -195,6 +208,7 @@ func NotIn(field string, values ...interface{}) ConditionFunc {
 // Like is used to construct the expression "field LIKE value".
 func Like(field string, value interface{}) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).Like(field, value)
@@ -215,6 +229,7 @@ func Like(field string, value interface{}) ConditionFunc {
 // to simulate the behavior of the ILIKE operator.
 func ILike(field string, value interface{}) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).ILike(field, value)
@@ -231,6 +246,7 @@ func ILike(field string, value interface{}) ConditionFunc {
 // NotLike is used to construct the expression "field NOT LIKE value".
 func NotLike(field string, value interface{}) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).NotLike(field, value)
@@ -251,6 +267,7 @@ func NotLike(field string, value interface{}) ConditionFunc {
 // to simulate the behavior of the ILIKE operator.
 func NotILike(field string, value interface{}) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).NotILike(field, value)
@@ -267,6 +284,7 @@ func NotILike(field string, value interface{}) ConditionFunc {
 // IsNull is used to construct the expression "field IS NULL".
 func IsNull(field string) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).IsNull(field)
@@ -283,6 +301,7 @@ func IsNull(field string) ConditionFunc {
 // IsNotNull is used to construct the expression "field IS NOT NULL".
 func IsNotNull(field string) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).IsNotNull(field)
@@ -299,6 +318,7 @@ func IsNotNull(field string) ConditionFunc {
 // Between is used to construct the expression "field BETWEEN lower AND upper".
 func Between(field string, lower, upper interface{}) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).Between(field, lower, upper)
@@ -315,6 +335,7 @@ func Between(field string, lower, upper interface{}) ConditionFunc {
 // NotBetween is used to construct the expression "field NOT BETWEEN lower AND upper".
 func NotBetween(field string, lower, upper interface{}) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).NotBetween(field, lower, upper)
@@ -377,7 +398,11 @@ func Not(notExpr string) ConditionFunc {
 }
 
 // Exists is used to construct the expression "EXISTS (subquery)".
+// The subquery can be a *QueryBuilder.
 func Exists(subquery interface{}) ConditionFunc {
+	if sub, ok := subquery.(*QueryBuilder); ok {
+		subquery = sub.Clone()
+	}
 	return func(builder Builder) string {
 		switch builder.(type) {
 		case *BuilderSelect:
@@ -393,7 +418,11 @@ func Exists(subquery interface{}) ConditionFunc {
 }
 
 // NotExists is used to construct the expression "NOT EXISTS (subquery)".
+// The subquery can be a *QueryBuilder.
 func NotExists(subquery interface{}) ConditionFunc {
+	if sub, ok := subquery.(*QueryBuilder); ok {
+		subquery = sub.Clone()
+	}
 	return func(builder Builder) string {
 		switch builder.(type) {
 		case *BuilderSelect:
@@ -409,8 +438,11 @@ func NotExists(subquery interface{}) ConditionFunc {
 }
 
 // Any is used to construct the expression "field op ANY (value...)".
+// A *QueryBuilder value is used as a subquery.
 func Any(field, op string, values ...interface{}) ConditionFunc {
+	values = subqueries(values)
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).Any(field, op, values...)
@@ -425,8 +457,11 @@ func Any(field, op string, values ...interface{}) ConditionFunc {
 }
 
 // All is used to construct the expression "field op ALL (value...)".
+// A *QueryBuilder value is used as a subquery.
 func All(field, op string, values ...interface{}) ConditionFunc {
+	values = subqueries(values)
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).All(field, op, values...)
@@ -441,8 +476,11 @@ func All(field, op string, values ...interface{}) ConditionFunc {
 }
 
 // Some is used to construct the expression "field op SOME (value...)".
+// A *QueryBuilder value is used as a subquery.
 func Some(field, op string, values ...interface{}) ConditionFunc {
+	values = subqueries(values)
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).Some(field, op, values...)
@@ -464,6 +502,7 @@ func Some(field, op string, values ...interface{}) ConditionFunc {
 // the IS DISTINCT FROM operator.
 func IsDistinctFrom(field string, value interface{}) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).IsDistinctFrom(field, value)
@@ -485,6 +524,7 @@ func IsDistinctFrom(field string, value interface{}) ConditionFunc {
 // the IS NOT DISTINCT FROM operator.
 func IsNotDistinctFrom(field string, value interface{}) ConditionFunc {
 	return func(builder Builder) string {
+		field := quoteField(builder, field)
 		switch builder.(type) {
 		case *BuilderSelect:
 			return builder.(*BuilderSelect).IsNotDistinctFrom(field, value)
@@ -3,7 +3,8 @@ package db
 import (
 	"context"
 	"database/sql"
-	"errors"
+	"sync"
+	"sync/atomic"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -19,14 +20,22 @@ type Connection struct {
 	stdDb   *sql.DB
 	builder Builder
 	Error   error
-	tx      *sqlx.Tx
+
+	replicas []*Connection
+	balancer Balancer
+	inFlight atomic.Int64
+
+	middlewares     []Middleware
+	middlewareMutex sync.RWMutex
+
+	telemetry *telemetry
 }
 
 type CondFunc func(cond Cond) []string
 
 // NewConnection creates a new Connection with the provided config
 func NewConnection(config *Config) *Connection {
-	return &Connection{Config: config, DB: nil, stdDb: nil, builder: nil, Error: nil, tx: nil}
+	return &Connection{Config: config, DB: nil, stdDb: nil, builder: nil, Error: nil}
 }
 
 // GetDB returns the standard sql.DB connection
@@ -43,54 +52,86 @@ func (c *Connection) Open() (*sql.DB, error) {
 		return nil, err
 	}
 
+	c.configurePool(db)
 	c.stdDb = db
-	c.DB = sqlx.NewDb(c.stdDb, c.Config.Driver)
+	c.DB = sqlx.NewDb(c.stdDb, c.Config.SQLDriverName())
+
+	if err := c.openReplicas(); err != nil {
+		_ = c.DB.Close()
+		return nil, err
+	}
 
 	return c.GetDB(), nil
 }
 
+// configurePool applies the pool settings from the config to the given database handle
+func (c *Connection) configurePool(db *sql.DB) {
+	if c.Config.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(c.Config.MaxOpenConns)
+	}
+	if c.Config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.Config.MaxIdleConns)
+	}
+	if c.Config.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(c.Config.ConnMaxLifetime)
+	}
+	if c.Config.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(c.Config.ConnMaxIdleTime)
+	}
+}
+
+// PoolStats returns the connection pool statistics of the connection.
+// It returns zero stats if the connection has not been opened yet.
+func (c *Connection) PoolStats() sql.DBStats {
+	if c.stdDb == nil {
+		return sql.DBStats{}
+	}
+	return c.stdDb.Stats()
+}
+
 // Close closes the database connection
 func (c *Connection) Close() error {
+	if err := c.closeReplicas(); err != nil {
+		return err
+	}
 	if c.DB != nil {
 		return c.DB.Close()
 	}
 	return nil
 }
 
-// BeginTx starts a new transaction
-func (c *Connection) BeginTx(ctx context.Context) (*sqlx.Tx, error) {
-	if c.tx != nil {
-		return nil, errors.New("already in a transaction")
+// BeginTx starts a new transaction.
+// If the context already carries a transaction of this connection, a nested
+// transaction backed by a savepoint is started inside it instead.
+func (c *Connection) BeginTx(ctx context.Context) (*Tx, error) {
+	if parent, ok := TxFromContext(ctx, c); ok {
+		return parent.Begin(ctx)
 	}
+
+	_, end := c.startSpan(ctx, "BEGIN", "", "")
 	tx, err := c.DB.BeginTxx(ctx, nil)
+	end(err)
 	if err != nil {
 		return nil, err
 	}
-	c.tx = tx
-	return tx, nil
+	return &Tx{Tx: tx, conn: c, ctx: ctx}, nil
 }
 
-// Commit commits the current transaction
-func (c *Connection) Commit() error {
-	if c.tx == nil {
-		return errors.New("not in a transaction")
+// Transaction executes fn within a transaction carried by the context passed to fn.
+// If fn returns an error or panics, the transaction is rolled back.
+// Otherwise, the transaction is committed.
+func (c *Connection) Transaction(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	tx, err := c.BeginTx(ctx)
+	if err != nil {
+		return err
 	}
-	err := c.tx.Commit()
-	c.tx = nil
-	return err
-}
+	defer tx.finish(&err)
 
-// Rollback rolls back the current transaction
-func (c *Connection) Rollback() error {
-	if c.tx == nil {
-		return errors.New("not in a transaction")
-	}
-	err := c.tx.Rollback()
-	c.tx = nil
-	return err
+	return fn(WithTx(ctx, tx))
 }
 
-// InTransaction returns true if the connection is in a transaction
-func (c *Connection) InTransaction() bool {
-	return c.tx != nil
+// InTransaction returns true if the context carries an open transaction of the connection
+func (c *Connection) InTransaction(ctx context.Context) bool {
+	_, ok := TxFromContext(ctx, c)
+	return ok
 }
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"github.com/huandu/go-sqlbuilder"
+)
+
+// cte is a common table expression of the WITH clause of a query
+type cte struct {
+	name  string
+	query sqlbuilder.Builder
+}
+
+// With adds a common table expression to the WITH clause of the query, so
+// that the SELECT query sub can be referenced by name. The name may list the
+// columns of the expression, like "totals(user_id, total)". The arguments of
+// sub are bound before the ones of the query.
+//
+// The WITH clause is written before SELECT, UPDATE and DELETE queries, and
+// is kept when switching between them.
+//
+//	totals := db.Query().Table("orders").Select("user_id", "SUM(amount) AS total").GroupBy("user_id")
+//	db.Query().With("totals", totals).Table("totals").Select("*").Where(db.GT("total", 100))
+func (qb *QueryBuilder) With(name string, sub *QueryBuilder) *QueryBuilder {
+	qb = qb.mutable()
+	qb.ctes = append(qb.ctes, cte{name: name, query: sub.Clone()})
+	return qb
+}
+
+// WithRecursive adds a recursive common table expression to the WITH clause
+// of the query, the union of the SELECT queries anchor and recursive, which
+// references the expression by name.
+//
+// The WITH clause is written as WITH RECURSIVE, except on SQL Server, which
+// has no RECURSIVE keyword.
+//
+//	anchor := db.Query().Table("categories").Select("id", "parent_id", "name").Where(db.EQ("id", id))
+//	children := db.Query().Table("categories").Select("categories.id", "categories.parent_id", "categories.name").
+//		Join("tree", "tree.id = categories.parent_id")
+//	db.Query().WithRecursive("tree(id, parent_id, name)", anchor, children).Table("tree").Select("*")
+func (qb *QueryBuilder) WithRecursive(name string, anchor, recursive *QueryBuilder) *QueryBuilder {
+	qb = qb.mutable()
+	query := sqlbuilder.Buildf("%v UNION ALL %v", anchor.Clone(), recursive.Clone())
+	qb.ctes = append(qb.ctes, cte{name: name, query: query})
+	qb.recursive = true
+	return qb
+}
+
+// withCTEs attaches the WITH clause of the query, if any, to a SELECT,
+// UPDATE or DELETE builder.
+func (qb *QueryBuilder) withCTEs(b sqlbuilder.Builder) {
+	if len(qb.ctes) == 0 {
+		return
+	}
+
+	queries := make([]*sqlbuilder.CTEQueryBuilder, len(qb.ctes))
+	for i, cte := range qb.ctes {
+		queries[i] = sqlbuilder.CTEQuery(cte.name).As(cte.query)
+	}
+	cteb := GetFlavorForDialect(qb.conn.Config.Driver).NewCTEBuilder()
+	if qb.recursive && qb.conn.Config.Driver != DialectMsSQL {
+		cteb.WithRecursive(queries...)
+	} else {
+		cteb.With(queries...)
+	}
+
+	switch b := b.(type) {
+	case *sqlbuilder.SelectBuilder:
+		b.With(cteb)
+	case *sqlbuilder.UpdateBuilder:
+		b.With(cteb)
+	case *sqlbuilder.DeleteBuilder:
+		b.With(cteb)
+	}
+}
+
+// withoutCTEs returns a shallow copy of the QueryBuilder without its WITH
+// clause, to be wrapped in a derived table by a query carrying the clause.
+func (qb *QueryBuilder) withoutCTEs() *QueryBuilder {
+	c := *qb
+	c.ctes = nil
+	c.recursive = false
+	return &c
+}
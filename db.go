@@ -1,10 +1,13 @@
 package db
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -23,14 +26,79 @@ type Config struct {
 	Password string
 	Database string
 	Params   string
+
+	// SQLDriver is the database/sql driver used to open the connection.
+	// It defaults to DefaultDriverName(Driver).
+	SQLDriver string
+
+	// Connection pool settings, applied to the underlying *sql.DB when the
+	// connection is opened. Zero values leave the database/sql defaults intact.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// Replicas holds the configs of the read replicas of this connection.
+	// Missing ConnName and Driver values are inherited from the primary.
+	Replicas []*Config
+	// Balancer picks the replica for each read; defaults to round-robin.
+	Balancer Balancer
+	// Sticky routes reads to the primary after a write in the same context
+	// (see WithSticky).
+	Sticky bool
+
+	// Logger receives the queries run on the connection. It defaults to the
+	// logger of the DatabaseManager.
+	Logger QueryLogger
+
+	// ServerVersion is the version of the database server, such as 8.0.36.
+	// Features missing from older servers, such as INTERSECT and EXCEPT
+	// before MySQL 8.0.31, are rejected when it is older or empty.
+	ServerVersion string
+}
+
+// SQLDriverName returns the database/sql driver name for the connection
+func (c *Config) SQLDriverName() string {
+	if c.SQLDriver != "" {
+		return c.SQLDriver
+	}
+	return DefaultDriverName(c.Driver)
+}
+
+// serverAtLeast returns true if ServerVersion is the given version or a later
+// one. Suffixes such as -log or -MariaDB are ignored.
+func (c *Config) serverAtLeast(version ...int) bool {
+	parts := strings.Split(c.ServerVersion, ".")
+	for i, want := range version {
+		if i >= len(parts) {
+			return false
+		}
+		digits := strings.IndexFunc(parts[i], func(r rune) bool { return r < '0' || r > '9' })
+		if digits < 0 {
+			digits = len(parts[i])
+		}
+		got, err := strconv.Atoi(parts[i][:digits])
+		if err != nil {
+			return false
+		}
+		if got != want {
+			return got > want
+		}
+	}
+	return true
 }
 
 // DataSource represents the data source configuration for a database connection
 func (c *Config) DataSource() *DataSource {
+	port := ""
+	if c.Port > 0 {
+		port = strconv.Itoa(c.Port)
+	}
+
 	return &DataSource{
 		Dialect:  c.Driver,
 		Host:     c.Host,
-		Port:     strconv.Itoa(c.Port),
+		Port:     port,
 		Username: c.User,
 		Password: c.Password,
 		Name:     c.Database,
@@ -52,6 +120,7 @@ func (c *Config) DSN() string {
 type DatabaseManager struct {
 	mutex       sync.RWMutex
 	connections map[string]*Connection
+	logger      QueryLogger
 }
 
 // DM returns the singleton instance of DatabaseManager
@@ -109,6 +178,26 @@ func (m *DatabaseManager) All() map[string]*Connection {
 	return m.connections
 }
 
+// Stats returns the connection pool statistics of the named connection
+func (m *DatabaseManager) Stats(name string) (sql.DBStats, error) {
+	conn, found := m.Get(name)
+	if !found {
+		return sql.DBStats{}, fmt.Errorf("%w: %s", ErrConnectionNotFound, name)
+	}
+	return conn.PoolStats(), nil
+}
+
+// AllStats returns the connection pool statistics of all the connections
+func (m *DatabaseManager) AllStats() map[string]sql.DBStats {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	stats := make(map[string]sql.DBStats, len(m.connections))
+	for name, conn := range m.connections {
+		stats[name] = conn.PoolStats()
+	}
+	return stats
+}
+
 // RemoveAll closes and removes all the existing connections
 func (m *DatabaseManager) RemoveAll() error {
 	for connName := range m.All() {
@@ -138,6 +227,7 @@ func Get(name ...string) *Connection {
 
 // Conn sets the given connection for the QueryBuilder
 func (qb *QueryBuilder) Conn(connName ...string) *QueryBuilder {
+	qb = qb.mutable()
 	qb.conn = Get(connName...)
 	return qb
 }
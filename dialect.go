@@ -1,6 +1,8 @@
 package db
 
 import (
+	"sync"
+
 	"github.com/huandu/go-sqlbuilder"
 )
 
@@ -20,6 +22,33 @@ var SupportedDialects = []string{
 	DialectMsSQL,
 }
 
+// defaultDriverNames maps each dialect to the database/sql driver name used
+// to open its connections when Config.SQLDriver is empty
+var (
+	driverNamesMutex   sync.RWMutex
+	defaultDriverNames = map[string]string{
+		DialectSQLite: "sqlite3",
+		DialectMySQL:  "mysql",
+		DialectPgSQL:  "pgx",
+		DialectMsSQL:  "sqlserver",
+	}
+)
+
+// SetDefaultDriverName sets the database/sql driver name used for the dialect.
+// The driver packages under github.com/lemmego/db/drivers call it on import.
+func SetDefaultDriverName(dialect, driverName string) {
+	driverNamesMutex.Lock()
+	defer driverNamesMutex.Unlock()
+	defaultDriverNames[dialect] = driverName
+}
+
+// DefaultDriverName returns the database/sql driver name used for the dialect
+func DefaultDriverName(dialect string) string {
+	driverNamesMutex.RLock()
+	defer driverNamesMutex.RUnlock()
+	return defaultDriverNames[dialect]
+}
+
 // IsDialectSupported checks if the given dialect is supported
 func IsDialectSupported(dialect string) bool {
 	for _, d := range SupportedDialects {
@@ -61,3 +90,55 @@ func DBConnectorFactory(config *Config) DBConnector {
 		panic("unsupported dialect: " + config.Driver)
 	}
 }
+
+// SupportsTransactionalDDL reports whether schema changes can be rolled back
+// as part of a transaction in the given dialect
+func SupportsTransactionalDDL(dialect string) bool {
+	switch dialect {
+	case DialectSQLite, DialectPgSQL, DialectMsSQL:
+		return true
+	default:
+		return false
+	}
+}
+
+// listTablesQuery returns the query listing the user tables of the current database
+func listTablesQuery(dialect string) string {
+	switch dialect {
+	case DialectSQLite:
+		return "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'"
+	case DialectMySQL:
+		return "SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE'"
+	case DialectPgSQL:
+		return "SELECT tablename FROM pg_tables WHERE schemaname = current_schema()"
+	case DialectMsSQL:
+		return "SELECT TABLE_NAME FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_TYPE = 'BASE TABLE'"
+	default:
+		panic("unsupported dialect: " + dialect)
+	}
+}
+
+// savepointSQL returns the statement creating a savepoint in the given dialect
+func savepointSQL(dialect, name string) string {
+	if dialect == DialectMsSQL {
+		return "SAVE TRANSACTION " + name
+	}
+	return "SAVEPOINT " + name
+}
+
+// releaseSavepointSQL returns the statement releasing a savepoint in the given dialect.
+// SQL Server has no way to release a savepoint, so an empty string is returned for it.
+func releaseSavepointSQL(dialect, name string) string {
+	if dialect == DialectMsSQL {
+		return ""
+	}
+	return "RELEASE SAVEPOINT " + name
+}
+
+// rollbackToSavepointSQL returns the statement rolling back to a savepoint in the given dialect
+func rollbackToSavepointSQL(dialect, name string) string {
+	if dialect == DialectMsSQL {
+		return "ROLLBACK TRANSACTION " + name
+	}
+	return "ROLLBACK TO SAVEPOINT " + name
+}
@@ -0,0 +1,14 @@
+// Package mssql registers the go-mssqldb driver and makes it the default
+// driver of the mssql dialect.
+//
+//	import _ "github.com/lemmego/db/drivers/mssql"
+package mssql
+
+import (
+	"github.com/lemmego/db"
+	_ "github.com/microsoft/go-mssqldb"
+)
+
+func init() {
+	db.SetDefaultDriverName(db.DialectMsSQL, "sqlserver")
+}
@@ -0,0 +1,14 @@
+// Package pgx registers the pgx driver and makes it the default driver of
+// the pgsql dialect.
+//
+//	import _ "github.com/lemmego/db/drivers/pgx"
+package pgx
+
+import (
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/lemmego/db"
+)
+
+func init() {
+	db.SetDefaultDriverName(db.DialectPgSQL, "pgx")
+}
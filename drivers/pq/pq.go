@@ -0,0 +1,14 @@
+// Package pq registers the lib/pq driver and makes it the default driver of
+// the pgsql dialect.
+//
+//	import _ "github.com/lemmego/db/drivers/pq"
+package pq
+
+import (
+	"github.com/lemmego/db"
+	_ "github.com/lib/pq"
+)
+
+func init() {
+	db.SetDefaultDriverName(db.DialectPgSQL, "postgres")
+}
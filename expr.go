@@ -0,0 +1,73 @@
+package db
+
+import (
+	"fmt"
+)
+
+// Expr is an SQL expression which can be passed to SelectExpr and
+// OrderByExpr in place of a column, such as a window function or a Raw
+// expression.
+type Expr interface {
+	// build returns the SQL of the expression in the query, binding its
+	// arguments with b.
+	build(qb *QueryBuilder, b Builder) string
+}
+
+// selectedColumns returns the values passed to SelectExpr with the names of
+// their columns quoted, and records an error if one of them is neither a
+// string nor an Expr. A string which is not a column name is written as is.
+func (qb *QueryBuilder) selectedColumns(values []any) []any {
+	return qb.columns(values, func(column string) string {
+		return quoteAliased(qb.Flavor(), column)
+	})
+}
+
+// orderColumns returns the values passed to OrderByExpr with the names of
+// their columns quoted, and records an error if one of them is neither a
+// string nor an Expr. A string which is not a column is written as is.
+func (qb *QueryBuilder) orderColumns(values []any) []any {
+	return qb.columns(values, func(column string) string {
+		quoted, _ := quoteOrder(qb.Flavor(), column)
+		return quoted
+	})
+}
+
+// columns returns the values with their string columns replaced by quote
+func (qb *QueryBuilder) columns(values []any, quote func(string) string) []any {
+	columns := make([]any, len(values))
+	for i, value := range values {
+		switch v := value.(type) {
+		case string:
+			columns[i] = quote(v)
+		case Expr:
+			columns[i] = v
+		default:
+			qb.err = fmt.Errorf("unsupported column %v of type %T", value, value)
+		}
+	}
+	return columns
+}
+
+// expressions returns the SQL of the columns and expressions passed to
+// SelectExpr or OrderByExpr, binding their arguments with b.
+func (qb *QueryBuilder) expressions(b Builder, values []any) []string {
+	sqls := make([]string, len(values))
+	for i, value := range values {
+		switch v := value.(type) {
+		case Expr:
+			sqls[i] = v.build(qb, b)
+		case string:
+			sqls[i] = v
+		}
+	}
+	return sqls
+}
+
+// anys returns the columns as values to be passed to SelectExpr or OrderByExpr
+func anys(columns []string) []any {
+	values := make([]any, len(columns))
+	for i, column := range columns {
+		values[i] = column
+	}
+	return values
+}
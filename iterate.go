@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"iter"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrStop can be returned by the function passed to Each to stop the
+// iteration early without Each returning an error.
+var ErrStop = errors.New("stop iteration")
+
+var (
+	scannerType = reflect.TypeFor[sql.Scanner]()
+	timeType    = reflect.TypeFor[time.Time]()
+)
+
+// Rows are the rows returned by Fetch. Closing them ends the span of the
+// query and frees the read replica they are read from, which counts as busy
+// until then.
+type Rows struct {
+	*sqlx.Rows
+	release func()
+	once    sync.Once
+}
+
+// Close closes the rows and frees their replica
+func (r *Rows) Close() error {
+	var err error
+	if r.Rows != nil {
+		err = r.Rows.Close()
+	}
+	if r.release != nil {
+		r.once.Do(r.release)
+	}
+	return err
+}
+
+// Iterate runs the query and returns an iterator over its rows, each scanned
+// into a T. Rows are read one at a time as the iteration goes, and are closed
+// when it ends, including when the loop breaks early. The iteration stops at
+// the first error, which is yielded with the zero value of T.
+//
+//	for user, err := range db.Iterate[User](ctx, db.Query().Table("users").Select("*")) {
+//		if err != nil {
+//			return err
+//		}
+//		// ...
+//	}
+func Iterate[T any](ctx context.Context, qb *QueryBuilder) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+
+		rows, err := qb.Fetch(ctx)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var value T
+			if err := scanRow(rows.Rows, &value); err != nil {
+				yield(zero, err)
+				return
+			}
+			if !yield(value, nil) {
+				return
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			yield(zero, err)
+		}
+	}
+}
+
+// Each runs the query and calls fn with every row scanned into a T, without
+// loading the whole result in memory. It stops at the first error returned
+// by fn, which is returned unless it is ErrStop.
+func Each[T any](ctx context.Context, qb *QueryBuilder, fn func(T) error) error {
+	for value, err := range Iterate[T](ctx, qb) {
+		if err != nil {
+			return err
+		}
+		if err := fn(value); err != nil {
+			if errors.Is(err, ErrStop) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// scanRow scans the current row into dest. Structs are scanned by their db
+// tags and maps by column name; anything else must be a single column.
+func scanRow[T any](rows *sqlx.Rows, dest *T) error {
+	t := reflect.TypeFor[T]()
+	switch {
+	case t.Kind() == reflect.Map && t.Key().Kind() == reflect.String:
+		values := make(map[string]any)
+		if err := rows.MapScan(values); err != nil {
+			return err
+		}
+		m := reflect.MakeMapWithSize(t, len(values))
+		for column, value := range values {
+			v := reflect.ValueOf(value)
+			if !v.IsValid() {
+				v = reflect.Zero(t.Elem())
+			}
+			m.SetMapIndex(reflect.ValueOf(column).Convert(t.Key()), v)
+		}
+		reflect.ValueOf(dest).Elem().Set(m)
+		return nil
+	case t.Kind() == reflect.Struct && t != timeType && !reflect.PointerTo(t).Implements(scannerType):
+		return rows.StructScan(dest)
+	default:
+		return rows.Scan(dest)
+	}
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/huandu/go-sqlbuilder"
+)
+
+// ErrJoinNotSupported is returned when running a query with a join the
+// dialect does not support.
+var ErrJoinNotSupported = errors.New("join is not supported by the dialect")
+
+// On is used to construct the join condition "left op right" between two
+// columns, which are not bound as values.
+//
+//	db.Query().Table("users").LeftJoin("posts", db.On("posts.user_id", "=", "users.id"), db.EQ("posts.published", true))
+func On(left, op, right string) ConditionFunc {
+	return func(builder Builder) string {
+		return quoteField(builder, left) + " " + op + " " + quoteField(builder, right)
+	}
+}
+
+// LeftJoin adds a LEFT JOIN clause to the query. The conditions are joined
+// with AND, and their values are bound as arguments.
+func (qb *QueryBuilder) LeftJoin(table string, on ...ConditionFunc) *QueryBuilder {
+	return qb.join(sqlbuilder.LeftJoin, table, nil, on)
+}
+
+// RightJoin adds a RIGHT JOIN clause to the query. The conditions are joined
+// with AND, and their values are bound as arguments.
+//
+// RIGHT JOIN is only available since SQLite 3.39, so the query fails with
+// ErrJoinNotSupported on SQLite.
+func (qb *QueryBuilder) RightJoin(table string, on ...ConditionFunc) *QueryBuilder {
+	return qb.join(sqlbuilder.RightJoin, table, nil, on)
+}
+
+// FullJoin adds a FULL JOIN clause to the query. The conditions are joined
+// with AND, and their values are bound as arguments.
+//
+// FULL JOIN is only available since SQLite 3.39 and MySQL has none, so the
+// query fails with ErrJoinNotSupported on SQLite and MySQL.
+func (qb *QueryBuilder) FullJoin(table string, on ...ConditionFunc) *QueryBuilder {
+	return qb.join(sqlbuilder.FullJoin, table, nil, on)
+}
+
+// CrossJoin adds a CROSS JOIN clause to the query
+func (qb *QueryBuilder) CrossJoin(table string) *QueryBuilder {
+	return qb.join("CROSS", table, nil, nil)
+}
+
+// JoinSub adds a JOIN clause on the SELECT query sub, as a derived table
+// with the given alias. The arguments of sub are bound along with the ones
+// of the query.
+//
+//	counts := db.Query().Table("posts").Select("user_id", "COUNT(*) AS posts").GroupBy("user_id")
+//	db.Query().Table("users").Select("users.name", "counts.posts").
+//		JoinSub(counts, "counts", db.On("counts.user_id", "=", "users.id"))
+func (qb *QueryBuilder) JoinSub(sub *QueryBuilder, alias string, on ...ConditionFunc) *QueryBuilder {
+	return qb.join("", alias, sub, on)
+}
+
+// LeftJoinSub adds a LEFT JOIN clause on the SELECT query sub, as a derived
+// table with the given alias.
+func (qb *QueryBuilder) LeftJoinSub(sub *QueryBuilder, alias string, on ...ConditionFunc) *QueryBuilder {
+	return qb.join(sqlbuilder.LeftJoin, alias, sub, on)
+}
+
+// join adds a JOIN clause on a table, or on the subquery sub aliased as
+// table if sub is not nil.
+func (qb *QueryBuilder) join(option sqlbuilder.JoinOption, table string, sub *QueryBuilder, on []ConditionFunc) *QueryBuilder {
+	qb = qb.mutable()
+	unsupported := false
+	switch qb.conn.Config.Driver {
+	case DialectSQLite:
+		unsupported = option == sqlbuilder.RightJoin || option == sqlbuilder.FullJoin
+	case DialectMySQL:
+		unsupported = option == sqlbuilder.FullJoin
+	}
+	if unsupported {
+		qb.err = fmt.Errorf("%w: %s JOIN on %s", ErrJoinNotSupported, option, qb.conn.Config.Driver)
+		return qb
+	}
+
+	if qb.builder == nil {
+		qb.builder = SelectBuilder(qb.conn.ConnName)
+	}
+	if _, ok := qb.builder.(*BuilderSelect); !ok {
+		qb.err = fmt.Errorf("%s JOIN requires a SELECT query", option)
+		return qb
+	}
+
+	if sub != nil {
+		sub = sub.Clone()
+	}
+	qb.addClause(func(b Builder) {
+		sb := b.(*BuilderSelect)
+		target := quoteAliased(sb.Flavor(), table)
+		if sub != nil {
+			target = sb.BuilderAs(sub.subquery(), table)
+		}
+
+		exprs := make([]string, 0, len(on))
+		for _, cond := range on {
+			if expr := cond(b); expr != "" {
+				exprs = append(exprs, expr)
+			}
+		}
+		sb.JoinWithOption(option, target, exprs...)
+	})
+	return qb
+}
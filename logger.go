@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// QueryEvent describes a query run by a QueryBuilder
+type QueryEvent struct {
+	ConnName string
+	SQL      string
+	Args     []any
+	Duration time.Duration
+	// RowsAffected is the number of rows affected by a statement or returned
+	// by a query, or -1 when it is not known.
+	RowsAffected int64
+	Err          error
+	// Debug is true for queries of a QueryBuilder in debug mode
+	Debug bool
+}
+
+// QueryLogger receives the queries run on a connection.
+// It is set per connection with Config.Logger or for all the connections
+// with DatabaseManager.SetLogger.
+type QueryLogger interface {
+	LogQuery(ctx context.Context, event QueryEvent)
+}
+
+// SlogLogger is a QueryLogger writing to a slog.Logger.
+// Queries are logged at debug level (info level in debug mode), slow queries
+// at warn level and failed queries at error level.
+type SlogLogger struct {
+	Logger *slog.Logger
+	// SlowThreshold is the duration from which a query is logged as slow.
+	// Zero disables slow query reporting.
+	SlowThreshold time.Duration
+	// RedactArgs leaves the query arguments out of the logs
+	RedactArgs bool
+}
+
+// NewSlogLogger creates a new SlogLogger, writing to slog.Default() if logger is nil
+func NewSlogLogger(logger *slog.Logger) *SlogLogger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &SlogLogger{Logger: logger}
+}
+
+// LogQuery logs the query event
+func (l *SlogLogger) LogQuery(ctx context.Context, event QueryEvent) {
+	level, msg := slog.LevelDebug, "query"
+	if event.Debug {
+		level = slog.LevelInfo
+	}
+	if l.SlowThreshold > 0 && event.Duration >= l.SlowThreshold {
+		level, msg = slog.LevelWarn, "slow query"
+	}
+	if event.Err != nil && !errors.Is(event.Err, sql.ErrNoRows) {
+		level, msg = slog.LevelError, "query failed"
+	}
+
+	if !l.Logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("conn", event.ConnName),
+		slog.String("sql", event.SQL),
+	}
+	if l.RedactArgs {
+		attrs = append(attrs, slog.Int("args", len(event.Args)))
+	} else {
+		attrs = append(attrs, slog.Any("args", event.Args))
+	}
+	attrs = append(attrs, slog.Duration("duration", event.Duration))
+	if event.RowsAffected >= 0 {
+		attrs = append(attrs, slog.Int64("rows", event.RowsAffected))
+	}
+	if event.Err != nil {
+		attrs = append(attrs, slog.Any("error", event.Err))
+	}
+
+	l.Logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// SetLogger sets the logger of the connections without a Config.Logger of their own
+func (m *DatabaseManager) SetLogger(logger QueryLogger) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.logger = logger
+}
+
+// Logger returns the logger of the connections without a Config.Logger of their own
+func (m *DatabaseManager) Logger() QueryLogger {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.logger
+}
+
+// logger returns the logger of the connection, falling back to the logger of the manager
+func (c *Connection) logger() QueryLogger {
+	if c.Config.Logger != nil {
+		return c.Config.Logger
+	}
+	return DM().Logger()
+}
+
+// logQuery reports a query run by the QueryBuilder to the logger of its connection.
+// Queries of a QueryBuilder in debug mode are logged to slog.Default() when
+// no logger is configured.
+func (qb *QueryBuilder) logQuery(ctx context.Context, query string, args []any, start time.Time, rows int64, err error) {
+	logger := qb.conn.logger()
+	if logger == nil {
+		if !qb.debug {
+			return
+		}
+		logger = NewSlogLogger(nil)
+	}
+
+	logger.LogQuery(ctx, QueryEvent{
+		ConnName:     qb.conn.Config.ConnName,
+		SQL:          query,
+		Args:         args,
+		Duration:     time.Since(start),
+		RowsAffected: rows,
+		Err:          err,
+		Debug:        qb.debug,
+	})
+}
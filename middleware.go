@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Statement operations, telling how a Statement is run and where its outcome goes
+const (
+	OpQuery  = "query"  // Fetch: the rows are returned in Statement.Rows
+	OpGet    = "get"    // Scan: the first row is scanned into Statement.Dest
+	OpSelect = "select" // ScanAll: all the rows are scanned into Statement.Dest
+	OpExec   = "exec"   // Exec: the result is returned in Statement.Result
+)
+
+// Statement is a built query on its way to the database
+type Statement struct {
+	ConnName string
+	// Type is the query type: SELECT, INSERT, UPDATE or DELETE
+	Type string
+	// Op is the query operation: OpQuery, OpGet, OpSelect or OpExec
+	Op   string
+	SQL  string
+	Args []any
+	// Dest is the destination of OpGet and OpSelect queries
+	Dest any
+
+	// Rows holds the rows of an OpQuery query once it has run
+	Rows *sqlx.Rows
+	// Result holds the result of an OpExec query once it has run
+	Result sql.Result
+
+	// release ends an OpQuery query once its rows are closed, freeing the
+	// replica they are read from
+	release func()
+}
+
+// QueryHandler runs a query
+type QueryHandler func(ctx context.Context, q *Statement) error
+
+// Middleware wraps the execution of the queries of a connection.
+// A middleware can change the query before calling next, skip next and fill
+// in the outcome of the query itself, or inspect the error returned by next.
+type Middleware func(next QueryHandler) QueryHandler
+
+// Use adds middlewares to the connection. The first middleware added is
+// the outermost one, so it sees the query first and the error last.
+func (c *Connection) Use(middlewares ...Middleware) {
+	c.middlewareMutex.Lock()
+	defer c.middlewareMutex.Unlock()
+	c.middlewares = append(c.middlewares, middlewares...)
+}
+
+// chain wraps the handler in the middlewares of the connection
+func (c *Connection) chain(handler QueryHandler) QueryHandler {
+	c.middlewareMutex.RLock()
+	defer c.middlewareMutex.RUnlock()
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		handler = c.middlewares[i](handler)
+	}
+	return handler
+}
@@ -0,0 +1,519 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrMigrationLocked       = errors.New("migrations are locked by another process")
+	ErrDuplicateMigration    = errors.New("duplicate migration version")
+	ErrMigrationNotFound     = errors.New("migration not found")
+	ErrIrreversibleMigration = errors.New("migration has no down migration")
+)
+
+// migrationFileRegexp matches file names like 20240101120000_create_users.up.sql
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// MigrationFunc applies or reverts a migration using the given executor.
+// The executor is a transaction on dialects that support transactional DDL.
+type MigrationFunc func(ctx context.Context, tx sqlx.ExtContext) error
+
+// Migration is a single versioned schema change
+type Migration struct {
+	Version int64
+	Name    string
+	Up      MigrationFunc
+	Down    MigrationFunc
+}
+
+// MigrationStatus describes the state of a registered migration
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	Batch     int
+	AppliedAt *time.Time
+}
+
+// appliedMigration is a row of the migrations table
+type appliedMigration struct {
+	Version   int64     `db:"version"`
+	Name      string    `db:"name"`
+	Batch     int       `db:"batch"`
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+// Migrator runs versioned migrations against a connection
+type Migrator struct {
+	conn       *Connection
+	table      string
+	lockTable  string
+	migrations []*Migration
+}
+
+// NewMigrator creates a new Migrator for the given connection
+func NewMigrator(conn *Connection) *Migrator {
+	return &Migrator{conn: conn, table: "migrations", lockTable: "migrations_lock"}
+}
+
+// Table sets the name of the table that records the applied migrations.
+// The lock table is named after it with a "_lock" suffix.
+func (m *Migrator) Table(name string) *Migrator {
+	m.table = name
+	m.lockTable = name + "_lock"
+	return m
+}
+
+// Register adds Go migrations to the migrator
+func (m *Migrator) Register(migrations ...*Migration) error {
+	for _, migration := range migrations {
+		if m.find(migration.Version) != nil {
+			return fmt.Errorf("%w: %d", ErrDuplicateMigration, migration.Version)
+		}
+		m.migrations = append(m.migrations, migration)
+	}
+
+	slices.SortFunc(m.migrations, func(a, b *Migration) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+
+	return nil
+}
+
+// LoadFS registers the .sql migrations found in the root of fsys.
+// Files are named "<version>_<name>.up.sql" and "<version>_<name>.down.sql";
+// the down file is optional. Two migrations sharing a version fail with
+// ErrDuplicateMigration.
+func (m *Migrator) LoadFS(fsys fs.FS) error {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+
+	files := make(map[int64]*Migration)
+	for _, entry := range entries {
+		matches := migrationFileRegexp.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || matches == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid migration version in %s: %w", entry.Name(), err)
+		}
+
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return err
+		}
+
+		migration, found := files[version]
+		if !found {
+			migration = &Migration{Version: version, Name: matches[2]}
+			files[version] = migration
+		}
+		fn := &migration.Up
+		if matches[3] == "down" {
+			fn = &migration.Down
+		}
+		if migration.Name != matches[2] || *fn != nil {
+			return fmt.Errorf("%w: %d in %s", ErrDuplicateMigration, version, entry.Name())
+		}
+		*fn = sqlMigrationFunc(string(content))
+	}
+
+	for _, migration := range files {
+		if migration.Up == nil {
+			return fmt.Errorf("missing up migration for version %d", migration.Version)
+		}
+		if err := m.Register(migration); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sqlMigrationFunc returns a MigrationFunc executing the given SQL script
+func sqlMigrationFunc(script string) MigrationFunc {
+	return func(ctx context.Context, tx sqlx.ExtContext) error {
+		_, err := tx.ExecContext(ctx, script)
+		return err
+	}
+}
+
+// Up applies all the pending migrations as a new batch
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, m.up)
+}
+
+// Down reverts the migrations of the last batch
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.withLock(ctx, m.down)
+}
+
+// Redo reverts the last batch and applies the pending migrations again
+func (m *Migrator) Redo(ctx context.Context) error {
+	return m.withLock(ctx, func(ctx context.Context) error {
+		if err := m.down(ctx); err != nil {
+			return err
+		}
+		return m.up(ctx)
+	})
+}
+
+// Fresh drops all the tables of the database and applies every migration
+func (m *Migrator) Fresh(ctx context.Context) error {
+	return m.withLock(ctx, func(ctx context.Context) error {
+		if err := m.dropAllTables(ctx); err != nil {
+			return err
+		}
+		if err := m.ensureTable(ctx); err != nil {
+			return err
+		}
+		return m.up(ctx)
+	})
+}
+
+// Status returns the status of every registered migration
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		statuses[i] = MigrationStatus{Version: migration.Version, Name: migration.Name}
+		for _, record := range applied {
+			if record.Version == migration.Version {
+				appliedAt := record.AppliedAt
+				statuses[i].Applied = true
+				statuses[i].Batch = record.Batch
+				statuses[i].AppliedAt = &appliedAt
+				break
+			}
+		}
+	}
+
+	return statuses, nil
+}
+
+// ForceUnlock removes a stale lock left behind by a crashed process
+func (m *Migrator) ForceUnlock(ctx context.Context) error {
+	if err := m.ensureLockTable(ctx); err != nil {
+		return err
+	}
+	return m.unlock(ctx)
+}
+
+// up applies the pending migrations in version order
+func (m *Migrator) up(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	batch := 1
+	for _, record := range applied {
+		if record.Batch >= batch {
+			batch = record.Batch + 1
+		}
+	}
+
+	for _, migration := range m.migrations {
+		if slices.ContainsFunc(applied, func(r appliedMigration) bool { return r.Version == migration.Version }) {
+			continue
+		}
+
+		err := m.run(ctx, migration.Up, func(ctx context.Context, tx sqlx.ExtContext) error {
+			ib := GetFlavorForDialect(m.conn.Config.Driver).NewInsertBuilder()
+			ib.InsertInto(m.table).
+				Cols("version", "name", "batch", "applied_at").
+				Values(migration.Version, migration.Name, batch, time.Now().UTC())
+			query, args := ib.Build()
+			_, err := tx.ExecContext(ctx, query, args...)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// down reverts the migrations of the last batch in reverse version order.
+// Nothing is reverted if one of them is missing or has no down migration.
+func (m *Migrator) down(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil || len(applied) == 0 {
+		return err
+	}
+
+	lastBatch := 0
+	for _, record := range applied {
+		lastBatch = max(lastBatch, record.Batch)
+	}
+
+	var records []appliedMigration
+	for i := len(applied) - 1; i >= 0; i-- {
+		record := applied[i]
+		if record.Batch != lastBatch {
+			continue
+		}
+
+		migration := m.find(record.Version)
+		if migration == nil {
+			return fmt.Errorf("%w: %d_%s", ErrMigrationNotFound, record.Version, record.Name)
+		}
+		if migration.Down == nil {
+			return fmt.Errorf("%w: %d_%s", ErrIrreversibleMigration, record.Version, record.Name)
+		}
+		records = append(records, record)
+	}
+
+	for _, record := range records {
+		migration := m.find(record.Version)
+		err := m.run(ctx, migration.Down, func(ctx context.Context, tx sqlx.ExtContext) error {
+			db := GetFlavorForDialect(m.conn.Config.Driver).NewDeleteBuilder()
+			db.DeleteFrom(m.table).Where(db.Equal("version", record.Version))
+			query, args := db.Build()
+			_, err := tx.ExecContext(ctx, query, args...)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("rollback of migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// run executes a migration function followed by its bookkeeping, inside a
+// transaction when the dialect supports transactional DDL
+func (m *Migrator) run(ctx context.Context, fn MigrationFunc, record MigrationFunc) error {
+	if !SupportsTransactionalDDL(m.conn.Config.Driver) {
+		if fn != nil {
+			if err := fn(ctx, m.conn.DB); err != nil {
+				return err
+			}
+		}
+		return record(ctx, m.conn.DB)
+	}
+
+	tx, err := m.conn.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if fn != nil {
+		if err := fn(ctx, tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if err := record(ctx, tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// applied returns the applied migrations ordered by version
+func (m *Migrator) applied(ctx context.Context) ([]appliedMigration, error) {
+	sb := GetFlavorForDialect(m.conn.Config.Driver).NewSelectBuilder()
+	sb.Select("version", "name", "batch", "applied_at").From(m.table).OrderBy("version")
+	query, args := sb.Build()
+
+	var applied []appliedMigration
+	if err := m.conn.DB.SelectContext(ctx, &applied, query, args...); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// find returns the registered migration with the given version
+func (m *Migrator) find(version int64) *Migration {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return migration
+		}
+	}
+	return nil
+}
+
+// withLock runs fn while holding the migration lock
+func (m *Migrator) withLock(ctx context.Context, fn func(ctx context.Context) error) error {
+	if err := m.ensureLockTable(ctx); err != nil {
+		return err
+	}
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.unlock(context.WithoutCancel(ctx))
+
+	if err := m.ensureTable(ctx); err != nil {
+		return err
+	}
+	return fn(ctx)
+}
+
+// lock acquires the migration lock by inserting the single lock row.
+// The primary key makes a concurrent insert fail, so only one process wins.
+// A failed insert only reports ErrMigrationLocked when the lock row exists;
+// any other failure is returned as is.
+func (m *Migrator) lock(ctx context.Context) error {
+	flavor := GetFlavorForDialect(m.conn.Config.Driver)
+	ib := flavor.NewInsertBuilder()
+	ib.InsertInto(m.lockTable).Cols("id", "locked_at").Values(1, time.Now().UTC())
+	query, args := ib.Build()
+
+	_, err := m.conn.DB.ExecContext(ctx, query, args...)
+	if err == nil {
+		return nil
+	}
+
+	sb := flavor.NewSelectBuilder()
+	sb.Select("COUNT(*)").From(m.lockTable).Where(sb.Equal("id", 1))
+	countQuery, countArgs := sb.Build()
+
+	var held int
+	if countErr := m.conn.DB.GetContext(ctx, &held, countQuery, countArgs...); countErr == nil && held > 0 {
+		return fmt.Errorf("%w: %v", ErrMigrationLocked, err)
+	}
+	return fmt.Errorf("failed to acquire migration lock: %w", err)
+}
+
+// unlock releases the migration lock
+func (m *Migrator) unlock(ctx context.Context) error {
+	db := GetFlavorForDialect(m.conn.Config.Driver).NewDeleteBuilder()
+	db.DeleteFrom(m.lockTable).Where(db.Equal("id", 1))
+	query, args := db.Build()
+
+	_, err := m.conn.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// ensureTable creates the migrations table if it does not exist
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	ctb := &BuilderCreateTable{GetFlavorForDialect(m.conn.Config.Driver).NewCreateTableBuilder()}
+	ctb.CreateTable(m.table)
+	ctb.Define("version", "BIGINT", "PRIMARY KEY")
+	ctb.Define("name", "VARCHAR(255)", "NOT NULL")
+	ctb.Define("batch", "INTEGER", "NOT NULL")
+	ctb.Define("applied_at", timestampType(m.conn.Config.Driver), "NOT NULL")
+	return m.createTable(ctx, ctb, m.table)
+}
+
+// ensureLockTable creates the migrations lock table if it does not exist
+func (m *Migrator) ensureLockTable(ctx context.Context) error {
+	ctb := &BuilderCreateTable{GetFlavorForDialect(m.conn.Config.Driver).NewCreateTableBuilder()}
+	ctb.CreateTable(m.lockTable)
+	ctb.Define("id", "INTEGER", "PRIMARY KEY")
+	ctb.Define("locked_at", timestampType(m.conn.Config.Driver), "NOT NULL")
+	return m.createTable(ctx, ctb, m.lockTable)
+}
+
+// createTable executes the CREATE TABLE statement unless the table already exists
+func (m *Migrator) createTable(ctx context.Context, ctb *BuilderCreateTable, table string) error {
+	var query string
+	if m.conn.Config.Driver == DialectMsSQL {
+		// SQL Server has no CREATE TABLE IF NOT EXISTS
+		query, _ = ctb.Build()
+		query = fmt.Sprintf("IF OBJECT_ID(N'%s', N'U') IS NULL %s", table, query)
+	} else {
+		query, _ = ctb.IfNotExists().Build()
+	}
+
+	_, err := m.conn.DB.ExecContext(ctx, query)
+	return err
+}
+
+// dropAllTables drops every table of the database except the lock table
+func (m *Migrator) dropAllTables(ctx context.Context) error {
+	driver := m.conn.Config.Driver
+
+	// Foreign key checks are toggled per session, so everything runs on one connection
+	conn, err := m.conn.DB.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var tables []string
+	if err := conn.SelectContext(ctx, &tables, listTablesQuery(driver)); err != nil {
+		return err
+	}
+
+	switch driver {
+	case DialectSQLite:
+		_, err = conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF")
+		defer conn.ExecContext(context.WithoutCancel(ctx), "PRAGMA foreign_keys = ON")
+	case DialectMySQL:
+		_, err = conn.ExecContext(ctx, "SET FOREIGN_KEY_CHECKS = 0")
+		defer conn.ExecContext(context.WithoutCancel(ctx), "SET FOREIGN_KEY_CHECKS = 1")
+	case DialectMsSQL:
+		// SQL Server cannot turn foreign key checks off, so the constraints are dropped first
+		err = dropForeignKeys(ctx, conn)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		if table == m.lockTable {
+			continue
+		}
+
+		query := "DROP TABLE IF EXISTS " + QuoteIdentifier(driver, table)
+		if driver == DialectPgSQL {
+			query += " CASCADE"
+		}
+		if _, err := conn.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dropForeignKeys drops every foreign key constraint of a SQL Server database
+func dropForeignKeys(ctx context.Context, conn *sqlx.Conn) error {
+	var statements []string
+	err := conn.SelectContext(ctx, &statements, "SELECT 'ALTER TABLE ' + QUOTENAME(OBJECT_SCHEMA_NAME(parent_object_id)) + '.' + "+
+		"QUOTENAME(OBJECT_NAME(parent_object_id)) + ' DROP CONSTRAINT ' + QUOTENAME(name) FROM sys.foreign_keys")
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timestampType returns the column type used for timestamps in the given dialect
+func timestampType(dialect string) string {
+	if dialect == DialectPgSQL {
+		return "TIMESTAMP"
+	}
+	return "DATETIME"
+}
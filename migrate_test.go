@@ -0,0 +1,264 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func setupMigrator(t *testing.T) (*Migrator, *Connection) {
+	conn := NewConnection(&Config{
+		ConnName: "migrations",
+		Driver:   DialectSQLite,
+		Database: "migrationsdb",
+		Params:   "mode=memory&cache=shared",
+	})
+	if _, err := conn.Open(); err != nil {
+		t.Fatalf("Failed to open connection: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	m := NewMigrator(conn)
+	err := m.Register(&Migration{
+		Version: 1,
+		Name:    "create_users",
+		Up: func(ctx context.Context, tx sqlx.ExtContext) error {
+			ctb := &BuilderCreateTable{GetFlavorForDialect(DialectSQLite).NewCreateTableBuilder()}
+			ctb.CreateTable("users").IfNotExists()
+			ctb.Define("id", "INTEGER", "PRIMARY KEY")
+			ctb.Define("name", "VARCHAR(255)", "NOT NULL")
+			query, _ := ctb.Build()
+			_, err := tx.ExecContext(ctx, query)
+			return err
+		},
+		Down: func(ctx context.Context, tx sqlx.ExtContext) error {
+			_, err := tx.ExecContext(ctx, "DROP TABLE users")
+			return err
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to register migration: %v", err)
+	}
+
+	err = m.LoadFS(fstest.MapFS{
+		"2_create_posts.up.sql":   {Data: []byte("CREATE TABLE posts (id INTEGER PRIMARY KEY, user_id INTEGER NOT NULL);")},
+		"2_create_posts.down.sql": {Data: []byte("DROP TABLE posts;")},
+		"README.md":               {Data: []byte("ignored")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+
+	return m, conn
+}
+
+func tableExists(t *testing.T, conn *Connection, table string) bool {
+	var count int
+	err := conn.Get(&count, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table)
+	if err != nil {
+		t.Fatalf("Failed to check table %s: %v", table, err)
+	}
+	return count > 0
+}
+
+func TestMigrator(t *testing.T) {
+	m, conn := setupMigrator(t)
+	ctx := context.Background()
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	if !tableExists(t, conn, "users") || !tableExists(t, conn, "posts") {
+		t.Fatalf("Expected users and posts tables to be created")
+	}
+
+	err := m.Register(&Migration{
+		Version: 3,
+		Name:    "create_tags",
+		Up: func(ctx context.Context, tx sqlx.ExtContext) error {
+			_, err := tx.ExecContext(ctx, "CREATE TABLE tags (id INTEGER PRIMARY KEY)")
+			return err
+		},
+		Down: func(ctx context.Context, tx sqlx.ExtContext) error {
+			_, err := tx.ExecContext(ctx, "DROP TABLE tags")
+			return err
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to register migration: %v", err)
+	}
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if len(statuses) != 3 {
+		t.Fatalf("Expected 3 migrations, got %d", len(statuses))
+	}
+	for i, expectedBatch := range []int{1, 1, 2} {
+		if !statuses[i].Applied || statuses[i].Batch != expectedBatch || statuses[i].AppliedAt == nil {
+			t.Errorf("Expected migration %d to be applied in batch %d, got %+v", statuses[i].Version, expectedBatch, statuses[i])
+		}
+	}
+
+	if err := m.Redo(ctx); err != nil {
+		t.Fatalf("Redo failed: %v", err)
+	}
+	statuses, _ = m.Status(ctx)
+	if !statuses[2].Applied || statuses[2].Batch != 2 || !tableExists(t, conn, "tags") {
+		t.Errorf("Expected redo to re-apply the last batch, got %+v", statuses[2])
+	}
+
+	if err := m.Down(ctx); err != nil {
+		t.Fatalf("Down failed: %v", err)
+	}
+	if tableExists(t, conn, "tags") || !tableExists(t, conn, "users") || !tableExists(t, conn, "posts") {
+		t.Errorf("Expected down to only revert the last batch")
+	}
+
+	if err := m.Down(ctx); err != nil {
+		t.Fatalf("Down failed: %v", err)
+	}
+	if tableExists(t, conn, "users") || tableExists(t, conn, "posts") {
+		t.Errorf("Expected all tables to be dropped after rolling back every batch")
+	}
+
+	conn.MustExec("CREATE TABLE leftovers (id INTEGER)")
+	conn.MustExec(`CREATE TABLE "order" (id INTEGER)`)
+	if err := m.Fresh(ctx); err != nil {
+		t.Fatalf("Fresh failed: %v", err)
+	}
+	if tableExists(t, conn, "leftovers") || tableExists(t, conn, "order") || !tableExists(t, conn, "users") {
+		t.Errorf("Expected fresh to drop all tables and migrate again")
+	}
+
+	// Clean up the shared in-memory database for other tests
+	conn.MustExec("DROP TABLE users")
+	conn.MustExec("DROP TABLE posts")
+	conn.MustExec("DROP TABLE tags")
+}
+
+func TestMigratorLock(t *testing.T) {
+	m, _ := setupMigrator(t)
+	ctx := context.Background()
+
+	if err := m.ensureLockTable(ctx); err != nil {
+		t.Fatalf("Failed to create lock table: %v", err)
+	}
+	if err := m.lock(ctx); err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+
+	if err := m.Up(ctx); !errors.Is(err, ErrMigrationLocked) {
+		t.Errorf("Expected ErrMigrationLocked, got %v", err)
+	}
+
+	if err := m.ForceUnlock(ctx); err != nil {
+		t.Fatalf("ForceUnlock failed: %v", err)
+	}
+	if err := m.Up(ctx); err != nil {
+		t.Errorf("Expected Up to succeed after unlocking, got %v", err)
+	}
+
+	m.conn.MustExec("DROP TABLE " + m.lockTable)
+	if err := m.lock(ctx); err == nil || errors.Is(err, ErrMigrationLocked) {
+		t.Errorf("Expected a failed lock without contention to not be ErrMigrationLocked, got %v", err)
+	}
+}
+
+func TestMigratorRollsBackFailedMigration(t *testing.T) {
+	m, conn := setupMigrator(t)
+	ctx := context.Background()
+
+	err := m.Register(&Migration{
+		Version: 3,
+		Name:    "broken",
+		Up: func(ctx context.Context, tx sqlx.ExtContext) error {
+			if _, err := tx.ExecContext(ctx, "CREATE TABLE half_done (id INTEGER)"); err != nil {
+				return err
+			}
+			return errors.New("intentional error")
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to register migration: %v", err)
+	}
+
+	if err := m.Fresh(ctx); err == nil {
+		t.Fatalf("Expected the broken migration to fail")
+	}
+	if tableExists(t, conn, "half_done") {
+		t.Errorf("Expected the failed migration to be rolled back")
+	}
+
+	statuses, _ := m.Status(ctx)
+	if statuses[2].Applied {
+		t.Errorf("Expected the failed migration to not be recorded")
+	}
+
+	if err := m.Register(&Migration{Version: 3, Name: "duplicate"}); !errors.Is(err, ErrDuplicateMigration) {
+		t.Errorf("Expected ErrDuplicateMigration, got %v", err)
+	}
+}
+
+func TestMigratorIrreversibleMigration(t *testing.T) {
+	m, conn := setupMigrator(t)
+	ctx := context.Background()
+
+	err := m.Register(&Migration{
+		Version: 3,
+		Name:    "create_notes",
+		Up: func(ctx context.Context, tx sqlx.ExtContext) error {
+			_, err := tx.ExecContext(ctx, "CREATE TABLE notes (id INTEGER PRIMARY KEY)")
+			return err
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to register migration: %v", err)
+	}
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	if err := m.Down(ctx); !errors.Is(err, ErrIrreversibleMigration) {
+		t.Fatalf("Expected ErrIrreversibleMigration, got %v", err)
+	}
+
+	statuses, _ := m.Status(ctx)
+	for _, status := range statuses {
+		if !status.Applied {
+			t.Errorf("Expected migration %d to stay applied, got %+v", status.Version, status)
+		}
+	}
+	if !tableExists(t, conn, "notes") || !tableExists(t, conn, "users") {
+		t.Errorf("Expected no migration of the batch to be reverted")
+	}
+}
+
+func TestLoadFSDuplicateVersions(t *testing.T) {
+	for name, files := range map[string]fstest.MapFS{
+		"same direction": {
+			"1_create_users.up.sql":   {Data: []byte("CREATE TABLE users (id INTEGER);")},
+			"1_create_people.up.sql":  {Data: []byte("CREATE TABLE people (id INTEGER);")},
+			"1_create_users.down.sql": {Data: []byte("DROP TABLE users;")},
+		},
+		"different names": {
+			"1_create_users.up.sql":    {Data: []byte("CREATE TABLE users (id INTEGER);")},
+			"1_create_people.down.sql": {Data: []byte("DROP TABLE people;")},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := NewMigrator(nil)
+			if err := m.LoadFS(files); !errors.Is(err, ErrDuplicateMigration) {
+				t.Errorf("Expected ErrDuplicateMigration, got %v", err)
+			}
+		})
+	}
+}
@@ -11,7 +11,7 @@ func NewMsSQLConnection(config *Config) *MsSQLConnection {
 }
 
 func (c *MsSQLConnection) Connect() (*sql.DB, error) {
-	db, err := sql.Open("mssql", c.config.DSN())
+	db, err := sql.Open(c.config.SQLDriverName(), c.config.DSN())
 	if err != nil {
 		return nil, err
 	}
@@ -11,7 +11,7 @@ func NewMySQLConnection(config *Config) *MySQLConnection {
 }
 
 func (c *MySQLConnection) Connect() (*sql.DB, error) {
-	db, err := sql.Open("mysql", c.config.DSN())
+	db, err := sql.Open(c.config.SQLDriverName(), c.config.DSN())
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,400 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Paginator is a page of results of an offset paginated query along with
+// the metadata needed to render pagination in an HTTP response.
+type Paginator struct {
+	Data        any        `json:"data"`
+	Total       int64      `json:"total"`
+	PerPage     int        `json:"per_page"`
+	CurrentPage int        `json:"current_page"`
+	LastPage    int        `json:"last_page"`
+	From        int        `json:"from"`
+	To          int        `json:"to"`
+	HasMore     bool       `json:"has_more"`
+	HasPrevious bool       `json:"has_previous"`
+	Links       *PageLinks `json:"links,omitempty"`
+}
+
+// PageLinks holds the URLs of the pages around the current page.
+// Prev and Next are empty when there is no such page.
+type PageLinks struct {
+	First string `json:"first"`
+	Last  string `json:"last"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+}
+
+// Paginate runs the query for the given page and scans the rows into dest.
+// The total number of rows is taken from a COUNT(*) query derived from the
+// same JOIN and WHERE clauses, without ORDER BY, LIMIT and OFFSET.
+// page is 1-based, perPage is the number of items per page.
+func (qb *QueryBuilder) Paginate(ctx context.Context, page, perPage int, dest interface{}) (*Paginator, error) {
+	qb = qb.scratch()
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = 10
+	}
+
+	var total int64
+	countSQL, countArgs := qb.countQuery()
+	if err := qb.get(ctx, &total, countSQL, countArgs); err != nil {
+		return nil, err
+	}
+
+	if err := qb.Page(page, perPage).ScanAll(ctx, dest); err != nil {
+		return nil, err
+	}
+
+	return newPaginator(dest, total, page, perPage), nil
+}
+
+// newPaginator computes the pagination metadata of a page
+func newPaginator(data any, total int64, page, perPage int) *Paginator {
+	lastPage := int((total + int64(perPage) - 1) / int64(perPage))
+	if lastPage < 1 {
+		lastPage = 1
+	}
+
+	p := &Paginator{
+		Data:        data,
+		Total:       total,
+		PerPage:     perPage,
+		CurrentPage: page,
+		LastPage:    lastPage,
+		HasMore:     page < lastPage,
+		HasPrevious: page > 1,
+	}
+
+	offset := int64((page - 1) * perPage)
+	if offset < total {
+		p.From = int(offset) + 1
+		p.To = int(min(offset+int64(perPage), total))
+	}
+
+	return p
+}
+
+// WithLinks fills in the links of the paginator from the URL of the current
+// request. The page and per_page query parameters are set on each link and
+// all the other parameters are kept.
+func (p *Paginator) WithLinks(base *url.URL) *Paginator {
+	link := func(page int) string {
+		u := *base
+		query := u.Query()
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(p.PerPage))
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+
+	p.Links = &PageLinks{
+		First: link(1),
+		Last:  link(p.LastPage),
+	}
+	if p.HasPrevious {
+		p.Links.Prev = link(min(p.CurrentPage-1, p.LastPage))
+	}
+	if p.HasMore {
+		p.Links.Next = link(p.CurrentPage + 1)
+	}
+
+	return p
+}
+
+// ErrInvalidCursor is returned when a pagination cursor cannot be decoded
+// or does not match the keyset columns of the query.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// CursorPaginator is a page of results of a keyset paginated query.
+// The cursors are opaque strings to be passed back to CursorPaginate to get
+// the following or the preceding page. They are empty when there is no such page.
+type CursorPaginator struct {
+	Data       any    `json:"data"`
+	PerPage    int    `json:"per_page"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+}
+
+// keysetColumn is a column of the sort order of a keyset paginated query
+type keysetColumn struct {
+	name string
+	desc bool
+}
+
+// cursor is the decoded form of a pagination cursor
+type cursor struct {
+	Direction string        `json:"d"`
+	Values    []cursorValue `json:"v"`
+}
+
+// cursorValue is a keyset value. Times are tagged so that they decode back to
+// time.Time and are bound the same way as the values they came from.
+type cursorValue struct {
+	Type  string `json:"t,omitempty"`
+	Value any    `json:"v"`
+}
+
+// CursorPaginate runs the query for the page after (or before) the given
+// cursor using keyset pagination and scans the rows into dest, which must be
+// a pointer to a slice of structs or maps.
+//
+// orderBy lists the sort columns, each optionally followed by ASC or DESC, and
+// replaces any ORDER BY of the query. The last column should be unique, such
+// as the primary key, so that rows sharing the other values are not skipped.
+// An empty cursor returns the first page.
+func (qb *QueryBuilder) CursorPaginate(ctx context.Context, cur string, perPage int, dest interface{}, orderBy ...string) (*CursorPaginator, error) {
+	qb = qb.scratch()
+	if len(orderBy) == 0 {
+		return nil, errors.New("cursor pagination requires at least one sort column")
+	}
+	if perPage < 1 {
+		perPage = 10
+	}
+
+	columns := make([]keysetColumn, len(orderBy))
+	for i, col := range orderBy {
+		columns[i] = parseKeysetColumn(col)
+	}
+
+	c := cursor{Direction: "next"}
+	if cur != "" {
+		decoded, err := decodeCursor(cur)
+		if err != nil {
+			return nil, err
+		}
+		if len(decoded.Values) != len(columns) {
+			return nil, ErrInvalidCursor
+		}
+		c = decoded
+	}
+	backward := c.Direction == "prev"
+
+	if len(c.Values) > 0 {
+		values := make([]any, len(c.Values))
+		for i, value := range c.Values {
+			values[i] = value.Value
+		}
+		qb.Where(keysetCondition(qb.conn.Config.Driver, columns, values, backward))
+	}
+
+	qb.orderBy = nil
+	for _, col := range columns {
+		if col.desc != backward {
+			qb.OrderBy(col.name + " DESC")
+		} else {
+			qb.OrderBy(col.name)
+		}
+	}
+
+	if err := qb.Limit(perPage+1).Offset(-1).ScanAll(ctx, dest); err != nil {
+		return nil, err
+	}
+
+	rows := reflect.ValueOf(dest).Elem()
+	more := rows.Len() > perPage
+	if more {
+		rows.Set(rows.Slice(0, perPage))
+	}
+	if backward {
+		swap := reflect.Swapper(rows.Interface())
+		for i, j := 0, rows.Len()-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+
+	p := &CursorPaginator{Data: dest, PerPage: perPage}
+	if rows.Len() == 0 {
+		return p, nil
+	}
+
+	var err error
+	if more || backward {
+		if p.NextCursor, err = qb.encodeCursor("next", rows.Index(rows.Len()-1), columns); err != nil {
+			return nil, err
+		}
+	}
+	if (more && backward) || (!backward && len(c.Values) > 0) {
+		if p.PrevCursor, err = qb.encodeCursor("prev", rows.Index(0), columns); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// parseKeysetColumn parses a sort column such as "created_at DESC"
+func parseKeysetColumn(col string) keysetColumn {
+	fields := strings.Fields(col)
+	if len(fields) > 1 {
+		switch strings.ToUpper(fields[len(fields)-1]) {
+		case "DESC":
+			return keysetColumn{name: strings.Join(fields[:len(fields)-1], " "), desc: true}
+		case "ASC":
+			return keysetColumn{name: strings.Join(fields[:len(fields)-1], " ")}
+		}
+	}
+	return keysetColumn{name: strings.TrimSpace(col)}
+}
+
+// keysetCondition returns the condition selecting the rows after the given
+// values in the sort order, or before them when backward is true.
+// A row value comparison is used when all the columns sort the same way and
+// the dialect supports it, and an expanded OR chain otherwise.
+func keysetCondition(dialect string, columns []keysetColumn, values []any, backward bool) ConditionFunc {
+	return func(b Builder) string {
+		cond := b.(Cond)
+		names := make([]string, len(columns))
+		for i, col := range columns {
+			names[i] = quoteField(b, col.name)
+		}
+		op := func(col keysetColumn) string {
+			if col.desc != backward {
+				return " < "
+			}
+			return " > "
+		}
+
+		uniform := true
+		for _, col := range columns[1:] {
+			if col.desc != columns[0].desc {
+				uniform = false
+			}
+		}
+
+		if uniform && len(columns) > 1 && dialect != DialectMsSQL {
+			vars := make([]string, len(columns))
+			for i := range columns {
+				vars[i] = cond.Var(values[i])
+			}
+			return "(" + strings.Join(names, ", ") + ")" + op(columns[0]) + "(" + strings.Join(vars, ", ") + ")"
+		}
+
+		ors := make([]string, len(columns))
+		for i, col := range columns {
+			ands := make([]string, 0, i+1)
+			for j := 0; j < i; j++ {
+				ands = append(ands, names[j]+" = "+cond.Var(values[j]))
+			}
+			ands = append(ands, names[i]+op(col)+cond.Var(values[i]))
+			if len(ands) == 1 {
+				ors[i] = ands[0]
+			} else {
+				ors[i] = cond.And(ands...)
+			}
+		}
+		if len(ors) == 1 {
+			return ors[0]
+		}
+		return cond.Or(ors...)
+	}
+}
+
+// rowField returns the value of the column in a scanned row, looked up by the
+// db tags of a struct or the keys of a map. The table qualifier of the column
+// is ignored. The returned value is invalid if the row has no such column.
+func (qb *QueryBuilder) rowField(row reflect.Value, column string) reflect.Value {
+	for row.Kind() == reflect.Pointer || row.Kind() == reflect.Interface {
+		row = row.Elem()
+	}
+
+	name := unqualified(column)
+	switch row.Kind() {
+	case reflect.Struct:
+		return qb.conn.DB.Mapper.FieldByName(row, name)
+	case reflect.Map:
+		return row.MapIndex(reflect.ValueOf(name))
+	default:
+		return reflect.Value{}
+	}
+}
+
+// unqualified strips the table qualifier of a column
+func unqualified(column string) string {
+	if dot := strings.LastIndex(column, "."); dot >= 0 {
+		return column[dot+1:]
+	}
+	return column
+}
+
+// encodeCursor builds the cursor pointing at the given row
+func (qb *QueryBuilder) encodeCursor(direction string, row reflect.Value, columns []keysetColumn) (string, error) {
+	c := cursor{Direction: direction, Values: make([]cursorValue, len(columns))}
+	for i, col := range columns {
+		field := qb.rowField(row, col.name)
+		if !field.IsValid() {
+			return "", fmt.Errorf("cursor column %s is not in the result", unqualified(col.name))
+		}
+
+		value := field.Interface()
+		if valuer, ok := value.(driver.Valuer); ok {
+			var err error
+			if value, err = valuer.Value(); err != nil {
+				return "", err
+			}
+		}
+		if t, ok := value.(time.Time); ok {
+			c.Values[i] = cursorValue{Type: "time", Value: t.Format(time.RFC3339Nano)}
+		} else {
+			c.Values[i] = cursorValue{Value: value}
+		}
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor decodes an opaque cursor
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&c); err != nil || (c.Direction != "next" && c.Direction != "prev") {
+		return c, ErrInvalidCursor
+	}
+
+	for i, value := range c.Values {
+		switch v := value.Value.(type) {
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				c.Values[i].Value = n
+			} else if f, err := v.Float64(); err == nil {
+				c.Values[i].Value = f
+			}
+		case string:
+			if value.Type == "time" {
+				t, err := time.Parse(time.RFC3339Nano, v)
+				if err != nil {
+					return c, ErrInvalidCursor
+				}
+				c.Values[i].Value = t
+			}
+		}
+	}
+
+	return c, nil
+}
@@ -11,7 +11,7 @@ func NewPgSQLConnection(config *Config) *PgSQLConnection {
 }
 
 func (c *PgSQLConnection) Connect() (*sql.DB, error) {
-	db, err := sql.Open("postgres", c.config.DSN())
+	db, err := sql.Open(c.config.SQLDriverName(), c.config.DSN())
 	if err != nil {
 		return nil, err
 	}
@@ -3,10 +3,13 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
 
 	"github.com/huandu/go-sqlbuilder"
 	"github.com/jmoiron/sqlx"
-	"github.com/k0kubun/pp/v3"
 )
 
 // Cond interface contains the convenience methods for building SQL conditions.
@@ -64,10 +67,31 @@ type QueryBuilder struct {
 	tableName     string
 	debug         bool
 	queryType     string
-	selectColumns []string
+	selectColumns []any
+	fromSub       *derivedTable
+	ctes          []cte
+	recursive     bool
+	setOps        []setOp
+	windows       []namedWindow
 	updatables    map[string]any
 	insertColumns []string
 	insertValues  [][]any
+	orderBy       []any
+	limit         int
+	offset        int
+	grouped       bool
+	upsert        *upsert
+	returning     []string
+	returningKey  string
+	onPrimary     bool
+	tx            *Tx
+	// err is an error found while building the query, returned when running it
+	err error
+
+	// clauses are the clauses added to the builder, replayed by Clone
+	clauses    []func(Builder)
+	rawBuilder bool
+	immutable  bool
 }
 
 // BuilderStruct provides common methods for building SQL queries using a struct.
@@ -102,23 +126,32 @@ type BuilderDelete struct {
 
 // NewQueryBuilder creates a new QueryBuilder instance.
 func NewQueryBuilder(conn *Connection) *QueryBuilder {
-	return &QueryBuilder{conn: conn}
+	return &QueryBuilder{conn: conn, limit: -1, offset: -1}
 }
 
 // SetBuilder sets the builder for the query builder.
 func (qb *QueryBuilder) SetBuilder(builder Builder) *QueryBuilder {
+	qb = qb.mutable()
 	qb.builder = builder
+	qb.clauses = nil
+	qb.rawBuilder = true
 	return qb
 }
 
 // GetBuilder returns the current builder.
+// The query is built from it as is once conditions are rendered on it, so
+// that they keep their arguments, and it can then no longer be cloned.
 func (qb *QueryBuilder) GetBuilder() Builder {
 	return qb.builder
 }
 
-// Table sets the table name for the query builder.
+// Table sets the table name for the query builder. The name, optionally
+// followed by an alias, is quoted if it is a reserved word.
 func (qb *QueryBuilder) Table(name string) *QueryBuilder {
+	qb = qb.mutable()
+	name = quoteAliased(qb.Flavor(), name)
 	qb.tableName = name
+	qb.fromSub = nil
 	switch b := qb.builder.(type) {
 	case *BuilderSelect:
 		b.From(name)
@@ -132,42 +165,71 @@ func (qb *QueryBuilder) Table(name string) *QueryBuilder {
 
 // Join adds a JOIN clause to the query builder.
 func (qb *QueryBuilder) Join(table string, onExpr ...string) *QueryBuilder {
-	qb.builder.(*BuilderSelect).Join(table, onExpr...)
+	qb = qb.mutable()
+	table = quoteAliased(qb.Flavor(), table)
+	qb.addClause(func(b Builder) {
+		b.(*BuilderSelect).Join(table, onExpr...)
+	})
 	return qb
 }
 
-// Select sets the columns to select
+// Select sets the columns to select. A column name, optionally followed by
+// an alias, is quoted if it is a reserved word, and any other string is
+// written as is. Use SelectExpr to select expressions.
 func (qb *QueryBuilder) Select(columns ...string) *QueryBuilder {
-	qb.queryType = "SELECT"
-	qb.builder = SelectBuilder(qb.conn.ConnName)
-	qb.selectColumns = columns
+	return qb.SelectExpr(anys(columns)...)
+}
+
+// SelectExpr sets the columns to select like Select, where a column is either
+// a string or an Expr such as a window function or a Raw expression.
+func (qb *QueryBuilder) SelectExpr(columns ...any) *QueryBuilder {
+	qb = qb.mutable()
+	qb.reset("SELECT", SelectBuilder(qb.conn.ConnName))
+	qb.selectColumns = qb.selectedColumns(columns)
 	return qb
 }
 
 // Insert sets up an INSERT query
 func (qb *QueryBuilder) Insert(columns []string, values [][]any) *QueryBuilder {
-	qb.queryType = "INSERT"
-	qb.builder = InsertBuilder(qb.conn.ConnName)
-	qb.insertColumns = columns
+	qb = qb.mutable()
+	qb.reset("INSERT", InsertBuilder(qb.conn.ConnName))
+	qb.insertColumns = quoteColumns(qb.Flavor(), columns)
 	qb.insertValues = values
 	return qb
 }
 
 // Update sets up an UPDATE query
 func (qb *QueryBuilder) Update(values map[string]any) *QueryBuilder {
-	qb.queryType = "UPDATE"
-	qb.builder = UpdateBuilder(qb.conn.ConnName)
+	qb = qb.mutable()
+	qb.reset("UPDATE", UpdateBuilder(qb.conn.ConnName))
 	qb.updatables = values
 	return qb
 }
 
 // Delete sets up a DELETE query
 func (qb *QueryBuilder) Delete() *QueryBuilder {
-	qb.queryType = "DELETE"
-	qb.builder = DeleteBuilder(qb.conn.ConnName)
+	qb = qb.mutable()
+	qb.reset("DELETE", DeleteBuilder(qb.conn.ConnName))
 	return qb
 }
 
+// reset starts a query of the given type on a new builder. The clauses of
+// the previous builder are dropped, but the derived table of a SELECT query
+// is kept.
+func (qb *QueryBuilder) reset(queryType string, builder Builder) {
+	qb.queryType = queryType
+	qb.builder = builder
+	qb.clauses = nil
+	qb.rawBuilder = false
+
+	if queryType != "SELECT" {
+		qb.fromSub = nil
+		qb.setOps = nil
+	} else if qb.fromSub != nil {
+		qb.addClause(qb.fromSub.clause)
+	}
+}
+
 // AsCreateTable returns the builder as a CreateTable builder.
 func (qb *QueryBuilder) AsCreateTable() *BuilderCreateTable {
 	if qb.builder == nil {
@@ -175,6 +237,7 @@ func (qb *QueryBuilder) AsCreateTable() *BuilderCreateTable {
 		qb.SetBuilder(ctb)
 		return ctb
 	}
+	qb.rawBuilder = true
 	return qb.builder.(*BuilderCreateTable)
 }
 
@@ -185,6 +248,7 @@ func (qb *QueryBuilder) AsSelect() *BuilderSelect {
 		qb.SetBuilder(sb)
 		return sb
 	}
+	qb.rawBuilder = true
 	return qb.builder.(*BuilderSelect)
 }
 
@@ -195,6 +259,7 @@ func (qb *QueryBuilder) AsInsert() *BuilderInsert {
 		qb.SetBuilder(ib)
 		return ib
 	}
+	qb.rawBuilder = true
 	return qb.builder.(*BuilderInsert)
 }
 
@@ -205,6 +270,7 @@ func (qb *QueryBuilder) AsUpdate() *BuilderUpdate {
 		qb.SetBuilder(ub)
 		return ub
 	}
+	qb.rawBuilder = true
 	return qb.builder.(*BuilderUpdate)
 }
 
@@ -215,11 +281,14 @@ func (qb *QueryBuilder) AsDelete() *BuilderDelete {
 		qb.SetBuilder(db)
 		return db
 	}
+	qb.rawBuilder = true
 	return qb.builder.(*BuilderDelete)
 }
 
 // Build builds the SQL query and returns the SQL string and arguments
 func (qb *QueryBuilder) Build() (string, []any) {
+	qb = qb.private()
+
 	// Initialize builder if not set
 	if qb.builder == nil {
 		switch qb.queryType {
@@ -244,62 +313,153 @@ func (qb *QueryBuilder) Build() (string, []any) {
 		if _, ok := qb.builder.(*BuilderSelect); !ok {
 			qb.builder = SelectBuilder(qb.conn.ConnName)
 		}
-		sb := qb.builder.(*BuilderSelect)
-		if qb.tableName != "" {
-			sb.From(qb.tableName)
-		}
-		if len(qb.selectColumns) > 0 {
-			sb.Select(qb.selectColumns...)
-		}
-		return sb.Build()
+		return qb.selectBuilder(nil, true).Build()
 	case "UPDATE":
 		if _, ok := qb.builder.(*BuilderUpdate); !ok {
 			qb.builder = UpdateBuilder(qb.conn.ConnName)
 		}
-		ub := qb.builder.(*BuilderUpdate)
+		final := *qb.freshBuilder().(*BuilderUpdate).UpdateBuilder
+		qb.withCTEs(&final)
 		if qb.tableName != "" {
-			ub.Update(qb.tableName)
+			final.Update(qb.tableName)
 		}
 		if len(qb.updatables) > 0 {
 			assignments := make([]string, 0, len(qb.updatables))
 			for col, val := range qb.updatables {
-				assignments = append(assignments, ub.Assign(col, val))
+				assignments = append(assignments, final.Assign(quoteColumn(qb.Flavor(), col), val))
+			}
+			if output := qb.outputClause("INSERTED"); output != "" {
+				assignments[len(assignments)-1] += " " + output
 			}
-			ub.Set(assignments...)
+			final.Set(assignments...)
 		}
-		return ub.Build()
+		if len(qb.orderBy) > 0 {
+			final.OrderBy(qb.expressions(&BuilderUpdate{&final}, qb.orderBy)...)
+		}
+		if qb.limit >= 0 {
+			final.Limit(qb.limit)
+		}
+		query, args := final.Build()
+		return query + qb.returningClause(), args
 	case "DELETE":
 		if _, ok := qb.builder.(*BuilderDelete); !ok {
 			qb.builder = DeleteBuilder(qb.conn.ConnName)
 		}
-		db := qb.builder.(*BuilderDelete)
+		final := *qb.freshBuilder().(*BuilderDelete).DeleteBuilder
+		qb.withCTEs(&final)
 		if qb.tableName != "" {
-			db.DeleteFrom(qb.tableName)
+			if output := qb.outputClause("DELETED"); output != "" {
+				final.DeleteFrom(qb.tableName + " " + output)
+			} else {
+				final.DeleteFrom(qb.tableName)
+			}
+		}
+		if len(qb.orderBy) > 0 {
+			final.OrderBy(qb.expressions(&BuilderDelete{&final}, qb.orderBy)...)
 		}
-		return db.Build()
+		if qb.limit >= 0 {
+			final.Limit(qb.limit)
+		}
+		query, args := final.Build()
+		return query + qb.returningClause(), args
 	case "INSERT":
 		if _, ok := qb.builder.(*BuilderInsert); !ok {
 			qb.builder = InsertBuilder(qb.conn.ConnName)
 		}
-		ib := qb.builder.(*BuilderInsert)
+		if qb.upsert != nil {
+			if err := qb.upsert.validate(qb.conn.Config.Driver, qb.insertColumns); err != nil {
+				qb.err = err
+				return "", nil
+			}
+		}
+		if qb.conn.Config.Driver == DialectMsSQL {
+			if qb.upsert != nil {
+				return qb.mergeQuery()
+			}
+			if len(qb.returning) > 0 {
+				return qb.outputInsertQuery()
+			}
+		}
+		final := *qb.freshBuilder().(*BuilderInsert).InsertBuilder
 		if qb.tableName != "" {
-			ib.InsertInto(qb.tableName)
+			final.InsertInto(qb.tableName)
 		}
 		if len(qb.insertColumns) > 0 {
-			ib.Cols(qb.insertColumns...)
+			final.Cols(qb.insertColumns...)
 			for _, row := range qb.insertValues {
-				ib.Values(row...)
+				final.Values(row...)
 			}
 		}
-		return ib.Build()
+		query, args := final.Build()
+		if qb.upsert != nil {
+			query += " " + qb.upsert.clause(qb.conn.Config.Driver, qb.insertColumns)
+		}
+		return query + qb.returningClause(), args
 	default:
 		// This should never happen due to the initialization above
 		return "", nil
 	}
 }
 
+// selectBuilder returns a copy of the SELECT builder with the WITH clause,
+// the table and the given columns applied, or the selected columns of the
+// query if columns is nil. A query combined by set operations is selected
+// from as a derived table instead. ORDER BY, LIMIT and OFFSET are applied
+// only when paged is true, and stripped otherwise. Building from a fresh
+// builder leaves the QueryBuilder and its arguments untouched, so it can be
+// built any number of times.
+func (qb *QueryBuilder) selectBuilder(columns []string, paged bool) sqlbuilder.Builder {
+	var sb *sqlbuilder.SelectBuilder
+	window := ""
+	if len(qb.setOps) > 0 {
+		sb = GetFlavorForDialect(qb.conn.Config.Driver).NewSelectBuilder()
+		sb.From(sb.BuilderAs(qb.combined(), "combined"))
+		if columns == nil {
+			columns = []string{"*"}
+		}
+	} else {
+		copied := *qb.freshBuilder().(*BuilderSelect).SelectBuilder
+		sb = &copied
+		if qb.tableName != "" {
+			sb.From(qb.tableName)
+		}
+		if columns == nil {
+			columns = qb.expressions(&BuilderSelect{sb}, qb.selectColumns)
+		}
+		window = qb.windowClause()
+	}
+	qb.withCTEs(sb)
+	if len(columns) > 0 {
+		sb.Select(columns...)
+	}
+	sb.Limit(-1).Offset(-1)
+
+	if !paged {
+		return withWindow(sb, sb, window)
+	}
+	head := *sb
+	if len(qb.orderBy) > 0 {
+		sb.OrderBy(qb.expressions(&BuilderSelect{sb}, qb.orderBy)...)
+	}
+	if qb.limit >= 0 {
+		sb.Limit(qb.limit)
+	}
+	if qb.offset >= 0 {
+		sb.Offset(qb.offset)
+	}
+	return withWindow(&head, sb, window)
+}
+
+// countQuery builds a COUNT(*) query over the rows matched by the SELECT query,
+// keeping its JOIN and WHERE clauses but not its ORDER BY, LIMIT and OFFSET.
+// Grouped queries are counted through a derived table.
+func (qb *QueryBuilder) countQuery() (string, []any) {
+	return qb.aggregateQuery("COUNT", "*")
+}
+
 // Where adds a WHERE clause to the query
 func (qb *QueryBuilder) Where(conditions ...ConditionFunc) *QueryBuilder {
+	qb = qb.mutable()
 	if qb.builder == nil {
 		switch qb.queryType {
 		case "SELECT":
@@ -312,65 +472,64 @@ func (qb *QueryBuilder) Where(conditions ...ConditionFunc) *QueryBuilder {
 			qb.builder = SelectBuilder(qb.conn.ConnName)
 		}
 	}
-	conditionsStr := make([]string, len(conditions))
-	for i, cond := range conditions {
-		conditionsStr[i] = cond(qb.builder)
-	}
-	// Call the builder's Where method
-	switch b := qb.builder.(type) {
-	case *BuilderSelect:
-		b.Where(conditionsStr...)
-	case *BuilderUpdate:
-		b.Where(conditionsStr...)
-	case *BuilderDelete:
-		b.Where(conditionsStr...)
-	}
+	qb.addClause(func(builder Builder) {
+		conditionsStr := make([]string, len(conditions))
+		for i, cond := range conditions {
+			conditionsStr[i] = cond(builder)
+		}
+		// Call the builder's Where method
+		switch b := builder.(type) {
+		case *BuilderSelect:
+			b.Where(conditionsStr...)
+		case *BuilderUpdate:
+			b.Where(conditionsStr...)
+		case *BuilderDelete:
+			b.Where(conditionsStr...)
+		}
+	})
 	return qb
 }
 
-// OrderBy adds an ORDER BY clause to the query builder.
+// OrderBy adds an ORDER BY clause to the query builder. A column name,
+// optionally followed by ASC or DESC and by NULLS FIRST or NULLS LAST, is
+// quoted if it is a reserved word, and any other string is written as is.
+// A sort parameter supplied by the user must go through OrderByAllowed
+// instead.
 func (qb *QueryBuilder) OrderBy(col ...string) *QueryBuilder {
-	switch builder := qb.builder.(type) {
-	case *BuilderSelect:
-		builder.OrderBy(col...)
-	case *BuilderUpdate:
-		builder.OrderBy(col...)
-	case *BuilderDelete:
-		builder.OrderBy(col...)
-	}
+	return qb.OrderByExpr(anys(col)...)
+}
 
+// OrderByExpr adds an ORDER BY clause like OrderBy, where a column is either
+// a string or an Expr such as a window function or a Raw expression.
+func (qb *QueryBuilder) OrderByExpr(col ...any) *QueryBuilder {
+	qb = qb.mutable()
+	qb.orderBy = append(qb.orderBy, qb.orderColumns(col)...)
 	return qb
 }
 
 // Limit adds a LIMIT clause to the query builder.
 func (qb *QueryBuilder) Limit(limit int) *QueryBuilder {
-	switch builder := qb.builder.(type) {
-	case *BuilderSelect:
-		builder.Limit(limit)
-	case *BuilderUpdate:
-		builder.Limit(limit)
-	case *BuilderDelete:
-		builder.Limit(limit)
-	}
-
+	qb = qb.mutable()
+	qb.limit = limit
 	return qb
 }
 
 // Offset adds an OFFSET clause to the query builder.
 func (qb *QueryBuilder) Offset(offset int) *QueryBuilder {
-	switch builder := qb.builder.(type) {
-	case *BuilderSelect:
-		builder.Offset(offset)
-	}
-
+	qb = qb.mutable()
+	qb.offset = offset
 	return qb
 }
 
 // GroupBy adds a GROUP BY clause to the query builder.
 func (qb *QueryBuilder) GroupBy(col ...string) *QueryBuilder {
-	switch builder := qb.builder.(type) {
-	case *BuilderSelect:
-		builder.GroupBy(col...)
+	qb = qb.mutable()
+	if _, ok := qb.builder.(*BuilderSelect); ok {
+		col = quoteColumns(qb.Flavor(), col)
+		qb.addClause(func(b Builder) {
+			b.(*BuilderSelect).GroupBy(col...)
+		})
+		qb.grouped = true
 	}
 
 	return qb
@@ -378,75 +537,69 @@ func (qb *QueryBuilder) GroupBy(col ...string) *QueryBuilder {
 
 // Having adds a HAVING clause to the query builder.
 func (qb *QueryBuilder) Having(condFuncs ...ConditionFunc) *QueryBuilder {
-	for _, condFunc := range condFuncs {
-		switch builder := qb.builder.(type) {
-		case *BuilderSelect:
-			builder.Having(condFunc(qb.builder))
-		}
+	qb = qb.mutable()
+	if _, ok := qb.builder.(*BuilderSelect); ok {
+		qb.addClause(func(b Builder) {
+			for _, condFunc := range condFuncs {
+				b.(*BuilderSelect).Having(condFunc(b))
+			}
+		})
 	}
 
 	return qb
 }
 
-// Fetch executes the query and returns the rows
-func (qb *QueryBuilder) Fetch(ctx context.Context) (*sqlx.Rows, error) {
+// Fetch executes the query and returns the rows, which must be closed
+func (qb *QueryBuilder) Fetch(ctx context.Context) (*Rows, error) {
+	qb = qb.private()
 	if qb.builder == nil {
 		qb.builder = SelectBuilder(qb.conn.ConnName)
 	}
 
 	sqlStmt, args := qb.Build()
-	if qb.debug {
-		pp.Println(sqlStmt, args)
-	}
-
-	if qb.conn.InTransaction() {
-		return qb.conn.tx.QueryxContext(ctx, sqlStmt, args...)
-	}
-	return qb.conn.DB.QueryxContext(ctx, sqlStmt, args...)
+	return qb.queryx(ctx, sqlStmt, args)
 }
 
 // Debug enables or disables debug mode for the query builder.
+// Queries in debug mode are logged at info level, to slog.Default() when the
+// connection has no logger.
 func (qb *QueryBuilder) Debug(log bool) *QueryBuilder {
+	qb = qb.mutable()
 	qb.debug = log
 	return qb
 }
 
 // Scan executes the query and scans the result into dest
 func (qb *QueryBuilder) Scan(ctx context.Context, dest interface{}) error {
+	qb = qb.private()
 	if qb.builder == nil {
 		qb.builder = SelectBuilder(qb.conn.ConnName)
 	}
-
-	query, args := qb.Build()
-	if qb.debug {
-		pp.Println(query, args)
+	if qb.emulatesReturning() {
+		return qb.insertAndSelect(ctx, dest, true)
 	}
 
-	if qb.conn.InTransaction() {
-		return qb.conn.tx.GetContext(ctx, dest, query, args...)
-	}
-	return qb.conn.DB.GetContext(ctx, dest, query, args...)
+	query, args := qb.Build()
+	return qb.get(ctx, dest, query, args)
 }
 
 // ScanAll executes the query and scans all results into dest
 func (qb *QueryBuilder) ScanAll(ctx context.Context, dest interface{}) error {
+	qb = qb.private()
 	if qb.builder == nil {
 		qb.builder = SelectBuilder(qb.conn.ConnName)
 	}
-
-	query, args := qb.Build()
-	if qb.debug {
-		pp.Println(query, args)
+	if qb.emulatesReturning() {
+		return qb.insertAndSelect(ctx, dest, false)
 	}
 
-	if qb.conn.InTransaction() {
-		return qb.conn.tx.SelectContext(ctx, dest, query, args...)
-	}
-	return qb.conn.DB.SelectContext(ctx, dest, query, args...)
+	query, args := qb.Build()
+	return qb.selectInto(ctx, dest, query, args)
 }
 
 // Exec executes the query and returns the result
 func (qb *QueryBuilder) Exec(ctx context.Context) (sql.Result, error) {
+	qb = qb.private()
 	if qb.builder == nil {
 		switch qb.queryType {
 		case "SELECT":
@@ -461,14 +614,144 @@ func (qb *QueryBuilder) Exec(ctx context.Context) (sql.Result, error) {
 	}
 
 	query, args := qb.Build()
-	if qb.debug {
-		pp.Println(query, args)
+	return qb.exec(ctx, query, args)
+}
+
+// queryx runs a built query and returns the rows
+func (qb *QueryBuilder) queryx(ctx context.Context, query string, args []any) (*Rows, error) {
+	q := qb.newQuery(OpQuery, query, args, nil)
+	err := qb.run(ctx, q)
+	rows := &Rows{Rows: q.Rows, release: q.release}
+	if err != nil || q.Rows == nil {
+		rows.Close()
+		return nil, err
+	}
+	return rows, nil
+}
+
+// get runs a built query and scans the first row into dest
+func (qb *QueryBuilder) get(ctx context.Context, dest interface{}, query string, args []any) error {
+	return qb.run(ctx, qb.newQuery(OpGet, query, args, dest))
+}
+
+// selectInto runs a built query and scans all the rows into dest
+func (qb *QueryBuilder) selectInto(ctx context.Context, dest interface{}, query string, args []any) error {
+	return qb.run(ctx, qb.newQuery(OpSelect, query, args, dest))
+}
+
+// exec runs a built statement and returns the result
+func (qb *QueryBuilder) exec(ctx context.Context, query string, args []any) (sql.Result, error) {
+	q := qb.newQuery(OpExec, query, args, nil)
+	err := qb.run(ctx, q)
+	return q.Result, err
+}
+
+// newQuery creates the Statement passed down the middleware chain of the connection
+func (qb *QueryBuilder) newQuery(op string, query string, args []any, dest interface{}) *Statement {
+	queryType := qb.queryType
+	if queryType == "" {
+		queryType = "SELECT"
 	}
+	return &Statement{
+		ConnName: qb.conn.Config.ConnName,
+		Type:     queryType,
+		Op:       op,
+		SQL:      query,
+		Args:     args,
+		Dest:     dest,
+	}
+}
 
-	if qb.conn.InTransaction() {
-		return qb.conn.tx.ExecContext(ctx, query, args...)
+// run passes the query through the middleware chain of the connection down to execute
+func (qb *QueryBuilder) run(ctx context.Context, q *Statement) error {
+	if qb.err != nil {
+		return qb.err
 	}
-	return qb.conn.DB.ExecContext(ctx, query, args...)
+	return qb.conn.chain(qb.execute)(ctx, q)
+}
+
+// execute runs the query in the transaction of the QueryBuilder or the
+// context. Reads go to a reader connection and writes to the primary.
+func (qb *QueryBuilder) execute(ctx context.Context, q *Statement) error {
+	ctx, end := qb.conn.startSpan(ctx, q.Type, qb.tableName, q.SQL)
+	start := time.Now()
+	rows := int64(-1)
+	tx, inTx := qb.txFor(ctx)
+
+	var err error
+	switch q.Op {
+	case OpExec:
+		// Writes made in a transaction are marked too, so that reads made
+		// with the context once the transaction is committed are sticky
+		qb.conn.markWritten(ctx)
+		if inTx {
+			q.Result, err = tx.ExecContext(ctx, q.SQL, q.Args...)
+		} else {
+			q.Result, err = qb.conn.DB.ExecContext(ctx, q.SQL, q.Args...)
+		}
+		if err == nil {
+			if affected, err := q.Result.RowsAffected(); err == nil {
+				rows = affected
+			}
+		}
+	default:
+		var queryer sqlx.QueryerContext = tx
+		if q.Type != "SELECT" || qb.onPrimary {
+			// Writes returning rows and reads of rows just written go to the primary
+			qb.conn.markWritten(ctx)
+			if !inTx {
+				queryer = qb.conn.DB
+			}
+		} else if !inTx {
+			reader := qb.conn.reader(ctx)
+			reader.inFlight.Add(1)
+			release := func() { reader.inFlight.Add(-1) }
+			if q.Op == OpQuery {
+				// The rows are read after the query returns, until they are closed
+				q.release = release
+			} else {
+				defer release()
+			}
+			queryer = reader.DB
+		}
+
+		switch q.Op {
+		case OpQuery:
+			q.Rows, err = queryer.QueryxContext(ctx, q.SQL, q.Args...)
+		case OpGet:
+			if err = sqlx.GetContext(ctx, queryer, q.Dest, q.SQL, q.Args...); err == nil {
+				rows = 1
+			} else if errors.Is(err, sql.ErrNoRows) {
+				rows = 0
+			}
+		case OpSelect:
+			err = sqlx.SelectContext(ctx, queryer, q.Dest, q.SQL, q.Args...)
+			if v := reflect.ValueOf(q.Dest); err == nil && v.Kind() == reflect.Pointer && v.Elem().Kind() == reflect.Slice {
+				rows = int64(v.Elem().Len())
+			}
+		default:
+			err = fmt.Errorf("unknown query operation %q", q.Op)
+		}
+	}
+
+	if q.Op == OpQuery && err == nil {
+		// The query runs until its rows are read and closed
+		release := q.release
+		q.release = func() {
+			if release != nil {
+				release()
+			}
+			var err error
+			if q.Rows != nil {
+				err = q.Rows.Err()
+			}
+			end(err)
+		}
+	} else {
+		end(err)
+	}
+	qb.logQuery(ctx, q.SQL, q.Args, start, rows, err)
+	return err
 }
 
 // getBuilderForDialect returns the appropriate builder flavor based on dialect
@@ -535,90 +818,103 @@ func (qb *QueryBuilder) Page(page, perPage int) *QueryBuilder {
 // Cursor adds cursor-based pagination to the query.
 // cursor is the value of the cursor field, direction is "next" or "prev",
 // and cursorField is the field to use for cursor-based pagination.
+//
+// Deprecated: use CursorPaginate, which supports several sort columns,
+// pages of any size and opaque cursors.
 func (qb *QueryBuilder) Cursor(cursor string, direction string, cursorField string) *QueryBuilder {
+	qb = qb.mutable()
 	if cursor == "" {
 		return qb.Limit(1)
 	}
+	field := quoteColumn(qb.Flavor(), cursorField)
 
 	switch direction {
 	case "next":
-		qb.Where(func(b Builder) string {
-			return b.(Cond).GreaterThan(cursorField, cursor)
+		qb = qb.Where(func(b Builder) string {
+			return b.(Cond).GreaterThan(field, cursor)
 		})
 	case "prev":
-		qb.Where(func(b Builder) string {
-			return b.(Cond).LessThan(cursorField, cursor)
+		qb = qb.Where(func(b Builder) string {
+			return b.(Cond).LessThan(field, cursor)
 		})
 	default:
 		// Default to next if direction is invalid
-		qb.Where(func(b Builder) string {
-			return b.(Cond).GreaterThan(cursorField, cursor)
+		qb = qb.Where(func(b Builder) string {
+			return b.(Cond).GreaterThan(field, cursor)
 		})
 	}
 
 	// Ensure we have proper ordering
 	if direction == "prev" {
-		qb.OrderBy(cursorField + " DESC")
+		qb = qb.OrderBy(cursorField + " DESC")
 	} else {
-		qb.OrderBy(cursorField)
+		qb = qb.OrderBy(cursorField)
 	}
 
 	return qb.Limit(1)
 }
 
-// Begin starts a new transaction.
+// Begin starts a new transaction and returns a QueryBuilder bound to it.
+// If the QueryBuilder or the context is already in a transaction, a nested
+// transaction backed by a savepoint is started instead.
 func (qb *QueryBuilder) Begin(ctx context.Context) (*QueryBuilder, error) {
-	_, err := qb.conn.BeginTx(ctx)
+	var tx *Tx
+	var err error
+	if parent, ok := qb.txFor(ctx); ok {
+		tx, err = parent.Begin(ctx)
+	} else {
+		tx, err = qb.conn.BeginTx(ctx)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	// Create a new QueryBuilder with the same connection and transaction
-	txQB := &QueryBuilder{
-		conn:      qb.conn,
-		builder:   qb.builder,
-		tableName: qb.tableName,
-		debug:     qb.debug,
-	}
+	// Create a copy of the QueryBuilder bound to the transaction
+	txQB := qb.Clone()
+	txQB.tx = tx
 
 	return txQB, nil
 }
 
 // Commit commits the transaction.
 func (qb *QueryBuilder) Commit() error {
-	return qb.conn.Commit()
+	if qb.tx == nil {
+		return errors.New("not in a transaction")
+	}
+	return qb.tx.Commit()
 }
 
 // Rollback rolls back the transaction.
 func (qb *QueryBuilder) Rollback() error {
-	return qb.conn.Rollback()
+	if qb.tx == nil {
+		return errors.New("not in a transaction")
+	}
+	return qb.tx.Rollback()
+}
+
+// Tx returns the transaction the QueryBuilder is bound to, if any.
+func (qb *QueryBuilder) Tx() *Tx {
+	return qb.tx
+}
+
+// txFor returns the transaction a query should run in: the one bound to the
+// QueryBuilder, or else the one of the connection carried by the context.
+func (qb *QueryBuilder) txFor(ctx context.Context) (*Tx, bool) {
+	if qb.tx != nil {
+		return qb.tx, true
+	}
+	return TxFromContext(ctx, qb.conn)
 }
 
 // Transaction executes the given function within a transaction.
 // If the function returns an error, the transaction is rolled back.
 // Otherwise, the transaction is committed.
-func (qb *QueryBuilder) Transaction(ctx context.Context, fn func(*QueryBuilder) error) error {
+func (qb *QueryBuilder) Transaction(ctx context.Context, fn func(*QueryBuilder) error) (err error) {
 	txQB, err := qb.Begin(ctx)
 	if err != nil {
 		return err
 	}
+	defer txQB.tx.finish(&err)
 
-	var txErr error
-	defer func() {
-		if p := recover(); p != nil {
-			// A panic occurred, rollback and repanic
-			_ = txQB.conn.Rollback()
-			// Re-throw the panic
-			panic(p)
-		} else if txErr != nil {
-			// Something went wrong, rollback
-			_ = txQB.conn.Rollback()
-		} else {
-			// All good, commit
-			txErr = txQB.conn.Commit()
-		}
-	}()
-
-	txErr = fn(txQB)
-	return txErr
+	return fn(txQB)
 }
@@ -1,16 +1,22 @@
 package db
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/huandu/go-sqlbuilder"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -1109,8 +1115,8 @@ func TestWhere(t *testing.T) {
 				qb.Table("users").
 					Select("*").
 					Where(And(
-						Equal("id", 1)(qb.builder),
-						Equal("name", "John")(qb.builder),
+						Equal("id", 1)(qb.GetBuilder()),
+						Equal("name", "John")(qb.GetBuilder()),
 					))
 			},
 			expectedSQL:   "SELECT * FROM users WHERE (id = ? AND name = ?)",
@@ -1137,8 +1143,8 @@ func TestWhere(t *testing.T) {
 				qb.Table("users").
 					Select("*").
 					Where(Or(
-						Equal("id", 1)(qb.builder),
-						Equal("name", "John")(qb.builder),
+						Equal("id", 1)(qb.GetBuilder()),
+						Equal("name", "John")(qb.GetBuilder()),
 					))
 			},
 			expectedSQL:   "SELECT * FROM users WHERE (id = ? OR name = ?)",
@@ -1151,11 +1157,11 @@ func TestWhere(t *testing.T) {
 				qb.Table("users").
 					Select("*").
 					Where(And(
-						GreaterThan("age", 18)(qb.builder),
+						GreaterThan("age", 18)(qb.GetBuilder()),
 						Or(
-							Equal("status", "active")(qb.builder),
-							Equal("status", "pending")(qb.builder),
-						)(qb.builder),
+							Equal("status", "active")(qb.GetBuilder()),
+							Equal("status", "pending")(qb.GetBuilder()),
+						)(qb.GetBuilder()),
 					))
 			},
 			expectedSQL:   "SELECT * FROM users WHERE (age > ? AND (status = ? OR status = ?))",
@@ -1212,9 +1218,9 @@ func TestWhere(t *testing.T) {
 				qb.Table("users").
 					Select("*").
 					Where(And(
-						Equal("status", "active")(qb.builder),
-						GreaterThan("age", 18)(qb.builder),
-						Like("email", "%@example.com")(qb.builder),
+						Equal("status", "active")(qb.GetBuilder()),
+						GreaterThan("age", 18)(qb.GetBuilder()),
+						Like("email", "%@example.com")(qb.GetBuilder()),
 					))
 			},
 			expectedSQL:   "SELECT * FROM users WHERE (status = ? AND age > ? AND email LIKE ?)",
@@ -1226,7 +1232,7 @@ func TestWhere(t *testing.T) {
 			setup: func(qb *QueryBuilder) {
 				qb.Table("users").
 					Select("*").
-					Where(Not(Equal("status", "inactive")(qb.builder)))
+					Where(Not(Equal("status", "inactive")(qb.GetBuilder())))
 			},
 			expectedSQL:   "SELECT * FROM users WHERE NOT status = ?",
 			expectedArgs:  []interface{}{"inactive"},
@@ -1264,3 +1270,2790 @@ func TestWhere(t *testing.T) {
 		})
 	}
 }
+
+func TestNestedTransaction(t *testing.T) {
+	setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	insertUser := func(qb *QueryBuilder, name string) error {
+		_, err := qb.Table("users").Insert([]string{"name", "created_at"}, [][]any{
+			{name, time.Now()},
+		}).Exec(ctx)
+		return err
+	}
+
+	err := Query().Transaction(ctx, func(qb *QueryBuilder) error {
+		if err := insertUser(qb, "Outer User"); err != nil {
+			return err
+		}
+
+		// A failing inner transaction only rolls back its own work
+		innerErr := qb.Transaction(ctx, func(inner *QueryBuilder) error {
+			if err := insertUser(inner, "Failed Inner User"); err != nil {
+				return err
+			}
+			return errors.New("intentional error")
+		})
+		if innerErr == nil {
+			t.Error("Expected inner transaction to fail")
+		}
+
+		return qb.Transaction(ctx, func(inner *QueryBuilder) error {
+			return insertUser(inner, "Inner User")
+		})
+	})
+	if err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+
+	if Get().InTransaction(ctx) {
+		t.Error("Expected the connection to be out of the transaction")
+	}
+
+	for name, expected := range map[string]int{"Outer User": 1, "Inner User": 1, "Failed Inner User": 0} {
+		var users []User
+		err := Query().Table("users").Select("*").Where(EQ("name", name)).ScanAll(ctx, &users)
+		if err != nil {
+			t.Errorf("Failed to query users: %v", err)
+		}
+		if len(users) != expected {
+			t.Errorf("Expected %d users named '%s', got %d", expected, name, len(users))
+		}
+	}
+}
+
+func TestSavepointSQL(t *testing.T) {
+	tests := []struct {
+		dialect  string
+		create   string
+		release  string
+		rollback string
+	}{
+		{DialectSQLite, "SAVEPOINT sp_1", "RELEASE SAVEPOINT sp_1", "ROLLBACK TO SAVEPOINT sp_1"},
+		{DialectMySQL, "SAVEPOINT sp_1", "RELEASE SAVEPOINT sp_1", "ROLLBACK TO SAVEPOINT sp_1"},
+		{DialectPgSQL, "SAVEPOINT sp_1", "RELEASE SAVEPOINT sp_1", "ROLLBACK TO SAVEPOINT sp_1"},
+		{DialectMsSQL, "SAVE TRANSACTION sp_1", "", "ROLLBACK TRANSACTION sp_1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dialect, func(t *testing.T) {
+			if got := savepointSQL(tt.dialect, "sp_1"); got != tt.create {
+				t.Errorf("Expected %q, got %q", tt.create, got)
+			}
+			if got := releaseSavepointSQL(tt.dialect, "sp_1"); got != tt.release {
+				t.Errorf("Expected %q, got %q", tt.release, got)
+			}
+			if got := rollbackToSavepointSQL(tt.dialect, "sp_1"); got != tt.rollback {
+				t.Errorf("Expected %q, got %q", tt.rollback, got)
+			}
+		})
+	}
+}
+
+func TestContextTransaction(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	countUsers := func(ctx context.Context, name string) int {
+		var count int
+		err := Query().Table("users").Select("COUNT(*)").Where(EQ("name", name)).Scan(ctx, &count)
+		if err != nil {
+			t.Fatalf("Failed to count users: %v", err)
+		}
+		return count
+	}
+
+	err := conn.Transaction(ctx, func(txCtx context.Context) error {
+		if !conn.InTransaction(txCtx) || conn.InTransaction(ctx) {
+			t.Error("Expected only the transaction context to carry the transaction")
+		}
+
+		_, err := Query().Table("users").Insert([]string{"name", "created_at"}, [][]any{
+			{"Context User", time.Now()},
+		}).Exec(txCtx)
+		if err != nil {
+			return err
+		}
+
+		if countUsers(txCtx, "Context User") != 1 {
+			t.Error("Expected the insert to be visible inside the transaction")
+		}
+		return errors.New("intentional error")
+	})
+	if err == nil {
+		t.Fatal("Expected the transaction to fail")
+	}
+
+	if countUsers(ctx, "Context User") != 0 {
+		t.Error("Expected the insert to be rolled back")
+	}
+}
+
+func TestConcurrentTransactions(t *testing.T) {
+	setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	// Transactions no longer live on the shared connection, so they don't collide
+	first, err := Query().Begin(ctx)
+	if err != nil {
+		t.Fatalf("Failed to begin the first transaction: %v", err)
+	}
+	second, err := Query().Begin(ctx)
+	if err != nil {
+		t.Fatalf("Failed to begin the second transaction: %v", err)
+	}
+
+	if first.Tx() == second.Tx() || first.Tx().Nested() || second.Tx().Nested() {
+		t.Error("Expected two independent top-level transactions")
+	}
+	if Get().InTransaction(ctx) {
+		t.Error("Expected unrelated contexts to not be in a transaction")
+	}
+
+	if err := first.Rollback(); err != nil {
+		t.Errorf("Failed to roll back the first transaction: %v", err)
+	}
+	if err := second.Rollback(); err != nil {
+		t.Errorf("Failed to roll back the second transaction: %v", err)
+	}
+	if err := second.Rollback(); !errors.Is(err, sql.ErrTxDone) {
+		t.Errorf("Expected sql.ErrTxDone for a finished transaction, got %v", err)
+	}
+}
+
+func TestRepo(t *testing.T) {
+	setupDb(DialectSQLite)
+	ctx := context.Background()
+	users := NewRepo[User]()
+
+	if users.Table() != "users" || users.PrimaryKey() != "id" {
+		t.Errorf("Expected table users with primary key id, got %s and %s", users.Table(), users.PrimaryKey())
+	}
+	if strings.Join(users.Columns(), ",") != "id,name,created_at" {
+		t.Errorf("Expected relation fields to be excluded from columns, got %v", users.Columns())
+	}
+
+	for _, name := range []string{"John Doe", "Jane Doe", "James Doe"} {
+		user := &User{Name: name, CreatedAt: time.Now()}
+		if err := users.Create(ctx, user); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if user.ID == 0 {
+			t.Errorf("Expected the generated primary key to be set on %s", name)
+		}
+	}
+
+	user, err := users.Find(ctx, 2)
+	if err != nil || user.Name != "Jane Doe" {
+		t.Fatalf("Expected to find Jane Doe, got %+v (%v)", user, err)
+	}
+
+	user.Name = "Jane Smith"
+	if err := users.Update(ctx, user); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	first, err := users.Where(Like("name", "Jane%")).First(ctx)
+	if err != nil || first.Name != "Jane Smith" {
+		t.Errorf("Expected the updated user, got %+v (%v)", first, err)
+	}
+
+	if err := users.Delete(ctx, 1); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := users.Find(ctx, 1); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows for a deleted user, got %v", err)
+	}
+
+	all, err := users.All(ctx)
+	if err != nil || len(all) != 2 {
+		t.Errorf("Expected 2 users, got %d (%v)", len(all), err)
+	}
+
+	count, err := users.Where(Like("name", "%Doe")).Count(ctx)
+	if err != nil || count != 1 {
+		t.Errorf("Expected 1 user named Doe, got %d (%v)", count, err)
+	}
+
+	exists, err := users.Where(EQ("name", "Nobody")).Exists(ctx)
+	if err != nil || exists {
+		t.Errorf("Expected no user named Nobody, got %v (%v)", exists, err)
+	}
+}
+
+func TestPluralize(t *testing.T) {
+	for name, expected := range map[string]string{
+		"user":     "users",
+		"category": "categories",
+		"day":      "days",
+		"address":  "addresses",
+		"box":      "boxes",
+		"user_tag": "user_tags",
+	} {
+		if got := pluralize(name); got != expected {
+			t.Errorf("Expected %s to be pluralized as %s, got %s", name, expected, got)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	_, err := QueryFromConn(conn).Table("users").Insert([]string{"id", "name", "created_at"}, [][]any{
+		{1, "John Doe", time.Now()},
+		{2, "Jane Doe", time.Now()},
+		{3, "James Doe", time.Now()},
+		{4, "Alice Smith", time.Now()},
+		{5, "Bob Smith", time.Now()},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		page        int
+		expectedIDs []uint64
+		from, to    int
+		hasMore     bool
+		hasPrevious bool
+	}{
+		{name: "first page", page: 1, expectedIDs: []uint64{3, 2}, from: 1, to: 2, hasMore: true},
+		{name: "last page", page: 2, expectedIDs: []uint64{1}, from: 3, to: 3, hasPrevious: true},
+		{name: "past the last page", page: 3, expectedIDs: []uint64{}, hasPrevious: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := []User{}
+			p, err := QueryFromConn(conn).Table("users").
+				Select("id", "name", "created_at").
+				Where(Like("name", "%Doe")).
+				OrderBy("id DESC").
+				Paginate(ctx, tt.page, 2, &users)
+			if err != nil {
+				t.Fatalf("Failed to paginate: %v", err)
+			}
+
+			if p.Total != 3 || p.LastPage != 2 || p.PerPage != 2 || p.CurrentPage != tt.page {
+				t.Errorf("Expected total 3 over 2 pages of 2, got %+v", p)
+			}
+			if p.From != tt.from || p.To != tt.to {
+				t.Errorf("Expected items %d to %d, got %d to %d", tt.from, tt.to, p.From, p.To)
+			}
+			if p.HasMore != tt.hasMore || p.HasPrevious != tt.hasPrevious {
+				t.Errorf("Expected has more %v and has previous %v, got %v and %v", tt.hasMore, tt.hasPrevious, p.HasMore, p.HasPrevious)
+			}
+			if len(users) != len(tt.expectedIDs) {
+				t.Fatalf("Expected %d users, got %d", len(tt.expectedIDs), len(users))
+			}
+			for i, user := range users {
+				if user.ID != tt.expectedIDs[i] {
+					t.Errorf("Expected user ID %d, got %d", tt.expectedIDs[i], user.ID)
+				}
+			}
+		})
+	}
+
+	t.Run("grouped query", func(t *testing.T) {
+		var names []string
+		p, err := QueryFromConn(conn).Table("users").
+			Select("name").
+			GroupBy("name").
+			Paginate(ctx, 1, 10, &names)
+		if err != nil {
+			t.Fatalf("Failed to paginate: %v", err)
+		}
+		if p.Total != 5 || len(names) != 5 {
+			t.Errorf("Expected 5 groups, got total %d and %d rows", p.Total, len(names))
+		}
+	})
+
+	t.Run("leaves the query untouched", func(t *testing.T) {
+		qb := QueryFromConn(conn).Table("users").Select("id").OrderBy("id")
+		before, _ := qb.Build()
+
+		var ids []uint64
+		if _, err := qb.Paginate(ctx, 2, 2, &ids); err != nil {
+			t.Fatalf("Failed to paginate: %v", err)
+		}
+		if after, _ := qb.Build(); after != before {
+			t.Errorf("Expected the query to stay %q, got %q", before, after)
+		}
+
+		ids = nil
+		if err := qb.ScanAll(ctx, &ids); err != nil {
+			t.Fatalf("Failed to scan: %v", err)
+		}
+		if len(ids) != 5 {
+			t.Errorf("Expected 5 ids after paginating, got %v", ids)
+		}
+	})
+}
+
+func TestCountQuery(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+
+	qb := QueryFromConn(conn).Table("users").
+		Select("users.id", "posts.title").
+		Join("posts", "posts.user_id = users.id").
+		Where(EQ("users.name", "John")).
+		OrderBy("users.id DESC").
+		Page(2, 5)
+
+	query, args := qb.countQuery()
+	expected := "SELECT COUNT(*) FROM users JOIN posts ON posts.user_id = users.id WHERE users.name = ?"
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+	if len(args) != 1 || args[0] != "John" {
+		t.Errorf("Expected args [John], got %v", args)
+	}
+
+	// Building the data query afterwards and repeatedly keeps its clauses intact
+	for i := 0; i < 2; i++ {
+		query, _ = qb.Build()
+		expected = "SELECT users.id, posts.title FROM users JOIN posts ON posts.user_id = users.id WHERE users.name = ? ORDER BY users.id DESC LIMIT 5 OFFSET 5"
+		if query != expected {
+			t.Errorf("Expected %q, got %q", expected, query)
+		}
+	}
+
+	query, _ = QueryFromConn(conn).Table("posts").
+		Select("user_id", "COUNT(*)").
+		GroupBy("user_id").
+		OrderBy("user_id").
+		countQuery()
+	expected = "SELECT COUNT(*) FROM (SELECT user_id, COUNT(*) FROM posts GROUP BY user_id) AS t"
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+
+	query, _ = QueryFromConn(conn).Table("posts").
+		Select("DISTINCT user_id").
+		Where(GT("id", 1)).
+		countQuery()
+	expected = "SELECT COUNT(*) FROM (SELECT DISTINCT user_id FROM posts WHERE id > ?) AS t"
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+}
+
+func TestCountDistinct(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	_, err := QueryFromConn(conn).Table("users").Insert([]string{"id", "name", "created_at"}, [][]any{
+		{1, "John Doe", time.Now()},
+		{2, "John Doe", time.Now()},
+		{3, "Jane Doe", time.Now()},
+		{4, "Jane Doe", time.Now()},
+		{5, "Alice Smith", time.Now()},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	names := QueryFromConn(conn).Table("users").Select("DISTINCT name").OrderBy("name")
+	if count, err := names.Count(ctx); err != nil || count != 3 {
+		t.Errorf("Expected 3 distinct names, got %d (%v)", count, err)
+	}
+
+	var page []string
+	p, err := names.Paginate(ctx, 1, 2, &page)
+	if err != nil {
+		t.Fatalf("Failed to paginate: %v", err)
+	}
+	if p.Total != 3 || p.LastPage != 2 || fmt.Sprint(page) != "[Alice Smith Jane Doe]" {
+		t.Errorf("Expected the first 2 of 3 distinct names, got %v of %d", page, p.Total)
+	}
+
+	if count, err := QueryFromConn(conn).Table("users").Select("name").Count(ctx); err != nil || count != 5 {
+		t.Errorf("Expected 5 rows, got %d (%v)", count, err)
+	}
+}
+
+func TestPaginatorLinks(t *testing.T) {
+	base, _ := url.Parse("https://example.com/users?sort=name&page=2")
+	p := newPaginator([]User{}, 25, 2, 10).WithLinks(base)
+
+	expected := PageLinks{
+		First: "https://example.com/users?page=1&per_page=10&sort=name",
+		Last:  "https://example.com/users?page=3&per_page=10&sort=name",
+		Prev:  "https://example.com/users?page=1&per_page=10&sort=name",
+		Next:  "https://example.com/users?page=3&per_page=10&sort=name",
+	}
+	if *p.Links != expected {
+		t.Errorf("Expected links %+v, got %+v", expected, *p.Links)
+	}
+
+	data, err := json.Marshal(newPaginator([]User{}, 0, 1, 10))
+	if err != nil {
+		t.Fatalf("Failed to marshal paginator: %v", err)
+	}
+	expectedJSON := `{"data":[],"total":0,"per_page":10,"current_page":1,"last_page":1,"from":0,"to":0,"has_more":false,"has_previous":false}`
+	if string(data) != expectedJSON {
+		t.Errorf("Expected %s, got %s", expectedJSON, data)
+	}
+}
+
+func TestCursorPaginate(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	// Users share creation times, so the id breaks the ties
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err := QueryFromConn(conn).Table("users").Insert([]string{"id", "name", "created_at"}, [][]any{
+		{1, "John Doe", day},
+		{2, "Jane Doe", day.Add(time.Hour)},
+		{3, "James Doe", day},
+		{4, "Alice Smith", day.Add(time.Hour)},
+		{5, "Bob Smith", day},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	page := func(cursor string) ([]uint64, *CursorPaginator) {
+		t.Helper()
+		var users []User
+		p, err := QueryFromConn(conn).Table("users").
+			Select("id", "name", "created_at").
+			CursorPaginate(ctx, cursor, 2, &users, "created_at DESC", "id DESC")
+		if err != nil {
+			t.Fatalf("Failed to paginate: %v", err)
+		}
+		ids := []uint64{}
+		for _, user := range users {
+			ids = append(ids, user.ID)
+		}
+		return ids, p
+	}
+
+	expectedPages := [][]uint64{{4, 2}, {5, 3}, {1}}
+
+	var p *CursorPaginator
+	var ids []uint64
+	cursor := ""
+	for i, expected := range expectedPages {
+		ids, p = page(cursor)
+		if fmt.Sprint(ids) != fmt.Sprint(expected) {
+			t.Errorf("Expected page %d to be %v, got %v", i+1, expected, ids)
+		}
+		if (p.PrevCursor == "") != (i == 0) {
+			t.Errorf("Expected page %d to have a previous cursor: %v", i+1, i > 0)
+		}
+		if (p.NextCursor == "") != (i == len(expectedPages)-1) {
+			t.Errorf("Expected page %d to have a next cursor: %v", i+1, i < len(expectedPages)-1)
+		}
+		cursor = p.NextCursor
+	}
+
+	// Walk back from the last page
+	for i := len(expectedPages) - 2; i >= 0; i-- {
+		ids, p = page(p.PrevCursor)
+		if fmt.Sprint(ids) != fmt.Sprint(expectedPages[i]) {
+			t.Errorf("Expected page %d to be %v, got %v", i+1, expectedPages[i], ids)
+		}
+		if p.NextCursor == "" {
+			t.Errorf("Expected page %d to have a next cursor", i+1)
+		}
+	}
+	if p.PrevCursor != "" {
+		t.Errorf("Expected no previous cursor on the first page, got %s", p.PrevCursor)
+	}
+
+	// Paginating twice on the same query returns the same page
+	qb := QueryFromConn(conn).Table("users").Select("id", "name", "created_at")
+	before, _ := qb.Build()
+	for i := 0; i < 2; i++ {
+		var users []User
+		if _, err := qb.CursorPaginate(ctx, "", 2, &users, "id"); err != nil {
+			t.Fatalf("Failed to paginate: %v", err)
+		}
+		if len(users) != 2 || users[0].ID != 1 || users[1].ID != 2 {
+			t.Errorf("Expected users 1 and 2 on call %d, got %+v", i+1, users)
+		}
+	}
+	if after, _ := qb.Build(); after != before {
+		t.Errorf("Expected the query to stay %q, got %q", before, after)
+	}
+
+	var users []User
+	_, err = QueryFromConn(conn).Table("users").Select("*").CursorPaginate(ctx, "not a cursor", 2, &users, "id")
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestKeysetCondition(t *testing.T) {
+	tests := []struct {
+		name     string
+		flavor   sqlbuilder.Flavor
+		dialect  string
+		columns  []string
+		backward bool
+		expected string
+	}{
+		{
+			name:     "single column",
+			flavor:   sqlbuilder.SQLite,
+			dialect:  DialectSQLite,
+			columns:  []string{"id"},
+			expected: "id > ?",
+		},
+		{
+			name:     "row value comparison",
+			flavor:   sqlbuilder.PostgreSQL,
+			dialect:  DialectPgSQL,
+			columns:  []string{"created_at DESC", "id DESC"},
+			expected: "(created_at, id) < ($1, $2)",
+		},
+		{
+			name:     "row value comparison backward",
+			flavor:   sqlbuilder.MySQL,
+			dialect:  DialectMySQL,
+			columns:  []string{"created_at", "id"},
+			backward: true,
+			expected: "(created_at, id) < (?, ?)",
+		},
+		{
+			name:     "mixed directions",
+			flavor:   sqlbuilder.PostgreSQL,
+			dialect:  DialectPgSQL,
+			columns:  []string{"name ASC", "id DESC"},
+			expected: "(name > $1 OR (name = $2 AND id < $3))",
+		},
+		{
+			name:     "expanded on sql server",
+			flavor:   sqlbuilder.SQLServer,
+			dialect:  DialectMsSQL,
+			columns:  []string{"created_at", "id"},
+			expected: "(created_at > @p1 OR (created_at = @p2 AND id > @p3))",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			columns := make([]keysetColumn, len(tt.columns))
+			values := make([]any, len(tt.columns))
+			for i, col := range tt.columns {
+				columns[i] = parseKeysetColumn(col)
+				values[i] = i
+			}
+
+			sb := &BuilderSelect{tt.flavor.NewSelectBuilder()}
+			sb.Select("*").From("users")
+			sb.Where(keysetCondition(tt.dialect, columns, values, tt.backward)(sb))
+			query, _ := sb.Build()
+
+			if !strings.HasSuffix(query, "WHERE "+tt.expected) {
+				t.Errorf("Expected condition %q, got %q", tt.expected, query)
+			}
+		})
+	}
+}
+
+// recordingLogger is a QueryLogger keeping the events it receives
+type recordingLogger struct {
+	mutex  sync.Mutex
+	events []QueryEvent
+}
+
+func (l *recordingLogger) LogQuery(ctx context.Context, event QueryEvent) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events = append(l.events, event)
+}
+
+func TestQueryLogger(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	logger := &recordingLogger{}
+	conn.Config.Logger = logger
+	defer func() { conn.Config.Logger = nil }()
+
+	_, err := QueryFromConn(conn).Table("users").Insert([]string{"id", "name", "created_at"}, [][]any{
+		{1, "John Doe", time.Now()},
+		{2, "Jane Doe", time.Now()},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	var users []User
+	if err := QueryFromConn(conn).Table("users").Select("*").Where(GT("id", 0)).ScanAll(ctx, &users); err != nil {
+		t.Fatalf("Failed to select users: %v", err)
+	}
+
+	var missing []User
+	scanErr := QueryFromConn(conn).Table("missing").Select("*").ScanAll(ctx, &missing)
+
+	if len(logger.events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(logger.events))
+	}
+
+	insert, sel, failed := logger.events[0], logger.events[1], logger.events[2]
+	if insert.ConnName != "default" || !strings.HasPrefix(insert.SQL, "INSERT INTO users") || insert.RowsAffected != 2 {
+		t.Errorf("Unexpected insert event: %+v", insert)
+	}
+	if sel.SQL != "SELECT * FROM users WHERE id > ?" || len(sel.Args) != 1 || sel.Args[0] != 0 || sel.RowsAffected != 2 || sel.Err != nil {
+		t.Errorf("Unexpected select event: %+v", sel)
+	}
+	if failed.Err == nil || failed.Err != scanErr || failed.RowsAffected != -1 {
+		t.Errorf("Expected the event of the failed query to carry its error, got %+v", failed)
+	}
+
+	// The manager logger is used by connections without a logger of their own
+	conn.Config.Logger = nil
+	global := &recordingLogger{}
+	DM().SetLogger(global)
+	defer DM().SetLogger(nil)
+
+	var count int
+	if err := QueryFromConn(conn).Table("users").Select("COUNT(*)").Scan(ctx, &count); err != nil {
+		t.Fatalf("Failed to count users: %v", err)
+	}
+	if len(global.events) != 1 || global.events[0].RowsAffected != 1 {
+		t.Errorf("Expected the manager logger to receive 1 event, got %+v", global.events)
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	tests := []struct {
+		name     string
+		setup    func(*SlogLogger)
+		event    QueryEvent
+		expected map[string]any
+	}{
+		{
+			name:     "debug level is filtered",
+			event:    QueryEvent{SQL: "SELECT 1", Duration: time.Millisecond, RowsAffected: 1},
+			expected: nil,
+		},
+		{
+			name:  "debug mode",
+			event: QueryEvent{ConnName: "default", SQL: "SELECT ?", Args: []any{1}, RowsAffected: 1, Debug: true},
+			expected: map[string]any{
+				"level": "INFO", "msg": "query", "conn": "default", "sql": "SELECT ?", "args": []any{1.0}, "rows": 1.0,
+			},
+		},
+		{
+			name:  "slow query",
+			setup: func(l *SlogLogger) { l.SlowThreshold = time.Second },
+			event: QueryEvent{SQL: "SELECT ?", Args: []any{"secret"}, Duration: 2 * time.Second, RowsAffected: -1},
+			expected: map[string]any{
+				"level": "WARN", "msg": "slow query", "sql": "SELECT ?", "args": []any{"secret"},
+			},
+		},
+		{
+			name:  "redacted failed query",
+			setup: func(l *SlogLogger) { l.RedactArgs = true },
+			event: QueryEvent{SQL: "SELECT ?", Args: []any{"secret"}, RowsAffected: -1, Err: errors.New("boom")},
+			expected: map[string]any{
+				"level": "ERROR", "msg": "query failed", "args": 1.0, "error": "boom",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			logger.SlowThreshold, logger.RedactArgs = 0, false
+			if tt.setup != nil {
+				tt.setup(logger)
+			}
+
+			logger.LogQuery(context.Background(), tt.event)
+
+			if tt.expected == nil {
+				if buf.Len() != 0 {
+					t.Errorf("Expected nothing to be logged, got %s", buf.String())
+				}
+				return
+			}
+
+			var record map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+				t.Fatalf("Failed to decode log record %q: %v", buf.String(), err)
+			}
+			for key, value := range tt.expected {
+				if fmt.Sprint(record[key]) != fmt.Sprint(value) {
+					t.Errorf("Expected %s to be %v, got %v", key, value, record[key])
+				}
+			}
+			if _, ok := record["rows"]; ok != (tt.event.RowsAffected >= 0) {
+				t.Errorf("Expected rows to be logged only when known, got %v", record["rows"])
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	_, err := QueryFromConn(conn).Table("users").Insert([]string{"id", "name", "created_at"}, [][]any{
+		{1, "John Doe", time.Now()},
+		{2, "Jane Doe", time.Now()},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	var calls []string
+	var failures []error
+	cached := map[string][]User{}
+
+	conn.Use(
+		// Observes the statements and their errors
+		func(next QueryHandler) QueryHandler {
+			return func(ctx context.Context, s *Statement) error {
+				calls = append(calls, s.Type+" "+s.Op)
+				err := next(ctx, s)
+				if err != nil {
+					failures = append(failures, err)
+				}
+				return err
+			}
+		},
+		// Serves cached selects without hitting the database
+		func(next QueryHandler) QueryHandler {
+			return func(ctx context.Context, s *Statement) error {
+				users, ok := cached[s.SQL]
+				if s.Op != OpSelect || !ok {
+					return next(ctx, s)
+				}
+				*s.Dest.(*[]User) = users
+				return nil
+			}
+		},
+		// Rewrites the statements to scope them to the Doe family
+		func(next QueryHandler) QueryHandler {
+			return func(ctx context.Context, s *Statement) error {
+				if s.Type == "SELECT" && !strings.Contains(s.SQL, "WHERE") {
+					s.SQL += " WHERE name LIKE ?"
+					s.Args = append(s.Args, "%Doe")
+				}
+				return next(ctx, s)
+			}
+		},
+	)
+
+	logger := &recordingLogger{}
+	conn.Config.Logger = logger
+	defer func() { conn.Config.Logger = nil }()
+
+	var users []User
+	if err := QueryFromConn(conn).Table("users").Select("*").ScanAll(ctx, &users); err != nil {
+		t.Fatalf("Failed to select users: %v", err)
+	}
+	if len(users) != 2 {
+		t.Errorf("Expected 2 users, got %d", len(users))
+	}
+	if len(logger.events) != 1 || logger.events[0].SQL != "SELECT * FROM users WHERE name LIKE ?" {
+		t.Errorf("Expected the rewritten query to be run, got %+v", logger.events)
+	}
+
+	cached["SELECT * FROM users WHERE id = ?"] = []User{{ID: 42, Name: "Cached"}}
+	users = nil
+	if err := QueryFromConn(conn).Table("users").Select("*").Where(EQ("id", 1)).ScanAll(ctx, &users); err != nil {
+		t.Fatalf("Failed to select users: %v", err)
+	}
+	if len(users) != 1 || users[0].ID != 42 {
+		t.Errorf("Expected the cached user, got %+v", users)
+	}
+	if len(logger.events) != 1 {
+		t.Errorf("Expected the cached query not to reach the database, got %d events", len(logger.events))
+	}
+
+	_, err = QueryFromConn(conn).Table("missing").Delete().Where(EQ("id", 1)).Exec(ctx)
+	if err == nil || len(failures) != 1 || failures[0] != err {
+		t.Errorf("Expected the middleware to observe the error %v, got %v", err, failures)
+	}
+
+	expectedCalls := []string{"SELECT select", "SELECT select", "DELETE exec"}
+	if fmt.Sprint(calls) != fmt.Sprint(expectedCalls) {
+		t.Errorf("Expected calls %v, got %v", expectedCalls, calls)
+	}
+}
+
+func TestRepoCreateReturning(t *testing.T) {
+	expected := map[string]string{
+		DialectPgSQL: "INSERT INTO users (name, created_at) VALUES ($1, $2) RETURNING id",
+		DialectMsSQL: "INSERT INTO users (name, created_at) OUTPUT INSERTED.id VALUES (@p1, @p2)",
+	}
+	for dialect, query := range expected {
+		t.Run(dialect, func(t *testing.T) {
+			conn := dialectConn(t, dialect)
+			var statements []string
+			conn.Use(func(next QueryHandler) QueryHandler {
+				return func(ctx context.Context, s *Statement) error {
+					statements = append(statements, s.Op+" "+s.SQL)
+					// Serve the generated key without a database
+					*s.Dest.(*uint64) = 42
+					return nil
+				}
+			})
+
+			user := &User{Name: "John Doe", CreatedAt: time.Now()}
+			if err := RepoFromConn[User](conn).Create(context.Background(), user); err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			if user.ID != 42 {
+				t.Errorf("Expected the returned primary key to be set, got %d", user.ID)
+			}
+			if fmt.Sprint(statements) != fmt.Sprint([]string{OpGet + " " + query}) {
+				t.Errorf("Expected %q, got %v", query, statements)
+			}
+		})
+	}
+}
+
+// dialectConn registers a connection of the given dialect backed by the fake
+// driver, for tests checking the SQL built for each dialect
+func dialectConn(t *testing.T, dialect string) *Connection {
+	t.Helper()
+	config := &Config{
+		ConnName:  "build_" + dialect,
+		Driver:    dialect,
+		Host:      "localhost",
+		User:      "app",
+		Database:  "app",
+		SQLDriver: "fake",
+	}
+	conn := NewConnection(config)
+	if _, err := conn.Open(); err != nil {
+		t.Fatalf("Failed to open %s connection: %v", dialect, err)
+	}
+	DM().Add(config.ConnName, conn)
+	t.Cleanup(func() { _ = DM().Remove(config.ConnName) })
+	return conn
+}
+
+func TestUpsertBuild(t *testing.T) {
+	rows := [][]any{{"john@example.com", "John"}, {"jane@example.com", "Jane"}}
+
+	tests := []struct {
+		name         string
+		dialect      string
+		setup        func(*QueryBuilder)
+		expectedSQL  string
+		expectedArgs int
+	}{
+		{
+			name:        "postgres do update",
+			dialect:     DialectPgSQL,
+			setup:       func(qb *QueryBuilder) { qb.OnConflict("email").DoUpdate("name") },
+			expectedSQL: "INSERT INTO users (email, name) VALUES ($1, $2), ($3, $4) ON CONFLICT (email) DO UPDATE SET name = EXCLUDED.name",
+		},
+		{
+			name:        "sqlite do update of all the other columns",
+			dialect:     DialectSQLite,
+			setup:       func(qb *QueryBuilder) { qb.OnConflict("email").DoUpdate() },
+			expectedSQL: "INSERT INTO users (email, name) VALUES (?, ?), (?, ?) ON CONFLICT (email) DO UPDATE SET name = EXCLUDED.name",
+		},
+		{
+			name:        "postgres do nothing",
+			dialect:     DialectPgSQL,
+			setup:       func(qb *QueryBuilder) { qb.OnConflict("email").DoNothing() },
+			expectedSQL: "INSERT INTO users (email, name) VALUES ($1, $2), ($3, $4) ON CONFLICT (email) DO NOTHING",
+		},
+		{
+			name:        "mysql do update",
+			dialect:     DialectMySQL,
+			setup:       func(qb *QueryBuilder) { qb.OnConflict("email").DoUpdate("name") },
+			expectedSQL: "INSERT INTO users (email, name) VALUES (?, ?), (?, ?) ON DUPLICATE KEY UPDATE name = VALUES(name)",
+		},
+		{
+			name:        "mysql do nothing",
+			dialect:     DialectMySQL,
+			setup:       func(qb *QueryBuilder) { qb.OnConflict("email").DoNothing() },
+			expectedSQL: "INSERT INTO users (email, name) VALUES (?, ?), (?, ?) ON DUPLICATE KEY UPDATE email = email",
+		},
+		{
+			name:    "mssql merge",
+			dialect: DialectMsSQL,
+			setup:   func(qb *QueryBuilder) { qb.OnConflict("email").DoUpdate("name") },
+			expectedSQL: "MERGE INTO users WITH (HOLDLOCK) AS target USING (VALUES (@p1, @p2), (@p3, @p4)) AS source (email, name) " +
+				"ON target.email = source.email WHEN MATCHED THEN UPDATE SET target.name = source.name " +
+				"WHEN NOT MATCHED THEN INSERT (email, name) VALUES (source.email, source.name);",
+		},
+		{
+			name:    "mssql merge do nothing",
+			dialect: DialectMsSQL,
+			setup:   func(qb *QueryBuilder) { qb.OnConflict("email").DoNothing() },
+			expectedSQL: "MERGE INTO users WITH (HOLDLOCK) AS target USING (VALUES (@p1, @p2), (@p3, @p4)) AS source (email, name) " +
+				"ON target.email = source.email " +
+				"WHEN NOT MATCHED THEN INSERT (email, name) VALUES (source.email, source.name);",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qb := QueryFromConn(dialectConn(t, tt.dialect)).Table("users").Insert([]string{"email", "name"}, rows)
+			tt.setup(qb)
+
+			query, args := qb.Build()
+			if query != tt.expectedSQL {
+				t.Errorf("Expected %q, got %q", tt.expectedSQL, query)
+			}
+			if fmt.Sprint(args) != "[john@example.com John jane@example.com Jane]" {
+				t.Errorf("Expected the inserted values as args, got %v", args)
+			}
+
+			// Building again gives the same query
+			if again, _ := qb.Build(); again != query {
+				t.Errorf("Expected the same query when built again, got %q", again)
+			}
+		})
+	}
+}
+
+func TestUpsertErrors(t *testing.T) {
+	ctx := context.Background()
+	rows := [][]any{{"john@example.com", "John"}}
+
+	tests := []struct {
+		name     string
+		dialect  string
+		query    func(*QueryBuilder) *QueryBuilder
+		expected string
+	}{
+		{
+			name:    "mssql without conflict keys",
+			dialect: DialectMsSQL,
+			query: func(qb *QueryBuilder) *QueryBuilder {
+				return qb.Insert([]string{"email", "name"}, rows).OnConflict().DoNothing()
+			},
+			expected: "upsert on mssql requires conflict keys to match the rows with MERGE",
+		},
+		{
+			name:    "pgsql update without conflict keys",
+			dialect: DialectPgSQL,
+			query: func(qb *QueryBuilder) *QueryBuilder {
+				return qb.Insert([]string{"email", "name"}, rows).OnConflict().DoUpdate()
+			},
+			expected: "upsert on pgsql requires conflict keys to update the conflicting rows",
+		},
+		{
+			name:    "sqlite update without conflict keys",
+			dialect: DialectSQLite,
+			query: func(qb *QueryBuilder) *QueryBuilder {
+				return qb.Insert([]string{"email", "name"}, rows).DoUpdate("name")
+			},
+			expected: "upsert on sqlite requires conflict keys to update the conflicting rows",
+		},
+		{
+			name:    "mysql without columns",
+			dialect: DialectMySQL,
+			query: func(qb *QueryBuilder) *QueryBuilder {
+				return qb.Insert(nil, nil).OnConflict().DoNothing()
+			},
+			expected: "upsert requires the columns to insert",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qb := tt.query(QueryFromConn(dialectConn(t, tt.dialect)).Table("users"))
+			if _, err := qb.Exec(ctx); err == nil || err.Error() != tt.expected {
+				t.Errorf("Expected error %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	upsert := func(name string, update bool) {
+		t.Helper()
+		qb := QueryFromConn(conn).Table("users").
+			Insert([]string{"id", "name", "created_at"}, [][]any{{1, name, time.Now()}}).
+			OnConflict("id")
+		if update {
+			qb.DoUpdate("name")
+		} else {
+			qb.DoNothing()
+		}
+		if _, err := qb.Exec(ctx); err != nil {
+			t.Fatalf("Failed to upsert: %v", err)
+		}
+	}
+
+	name := func() string {
+		t.Helper()
+		var name string
+		if err := QueryFromConn(conn).Table("users").Select("name").Where(EQ("id", 1)).Scan(ctx, &name); err != nil {
+			t.Fatalf("Failed to read user: %v", err)
+		}
+		return name
+	}
+
+	upsert("John Doe", true)
+	upsert("Jane Doe", true)
+	if got := name(); got != "Jane Doe" {
+		t.Errorf("Expected the conflicting row to be updated, got %s", got)
+	}
+
+	upsert("James Doe", false)
+	if got := name(); got != "Jane Doe" {
+		t.Errorf("Expected the conflicting row to be left alone, got %s", got)
+	}
+}
+
+func TestReturningBuild(t *testing.T) {
+	tests := []struct {
+		name        string
+		dialect     string
+		setup       func(*QueryBuilder)
+		expectedSQL string
+	}{
+		{
+			name:        "postgres insert",
+			dialect:     DialectPgSQL,
+			setup:       func(qb *QueryBuilder) { qb.Insert([]string{"name"}, [][]any{{"John"}}).Returning("id", "name") },
+			expectedSQL: "INSERT INTO users (name) VALUES ($1) RETURNING id, name",
+		},
+		{
+			name:    "postgres upsert",
+			dialect: DialectPgSQL,
+			setup: func(qb *QueryBuilder) {
+				qb.Insert([]string{"email", "name"}, [][]any{{"john@example.com", "John"}}).
+					OnConflict("email").DoUpdate().Returning("id")
+			},
+			expectedSQL: "INSERT INTO users (email, name) VALUES ($1, $2) ON CONFLICT (email) DO UPDATE SET name = EXCLUDED.name RETURNING id",
+		},
+		{
+			name:        "sqlite update",
+			dialect:     DialectSQLite,
+			setup:       func(qb *QueryBuilder) { qb.Update(map[string]any{"name": "John"}).Where(EQ("id", 1)).Returning("*") },
+			expectedSQL: "UPDATE users SET name = ? WHERE id = ? RETURNING *",
+		},
+		{
+			name:        "postgres delete",
+			dialect:     DialectPgSQL,
+			setup:       func(qb *QueryBuilder) { qb.Delete().Where(EQ("id", 1)).Returning("id", "name") },
+			expectedSQL: "DELETE FROM users WHERE id = $1 RETURNING id, name",
+		},
+		{
+			name:    "mssql insert",
+			dialect: DialectMsSQL,
+			setup: func(qb *QueryBuilder) {
+				qb.Insert([]string{"name"}, [][]any{{"John"}, {"Jane"}}).Returning("id", "name")
+			},
+			expectedSQL: "INSERT INTO users (name) OUTPUT INSERTED.id, INSERTED.name VALUES (@p1), (@p2)",
+		},
+		{
+			name:        "mssql update",
+			dialect:     DialectMsSQL,
+			setup:       func(qb *QueryBuilder) { qb.Update(map[string]any{"name": "John"}).Where(EQ("id", 1)).Returning("*") },
+			expectedSQL: "UPDATE users SET name = @p1 OUTPUT INSERTED.* WHERE id = @p2",
+		},
+		{
+			name:        "mssql delete",
+			dialect:     DialectMsSQL,
+			setup:       func(qb *QueryBuilder) { qb.Delete().Where(EQ("id", 1)).Returning("id") },
+			expectedSQL: "DELETE FROM users OUTPUT DELETED.id WHERE id = @p1",
+		},
+		{
+			name:    "mssql merge",
+			dialect: DialectMsSQL,
+			setup: func(qb *QueryBuilder) {
+				qb.Insert([]string{"email", "name"}, [][]any{{"john@example.com", "John"}}).
+					OnConflict("email").DoNothing().Returning("id")
+			},
+			expectedSQL: "MERGE INTO users WITH (HOLDLOCK) AS target USING (VALUES (@p1, @p2)) AS source (email, name) " +
+				"ON target.email = source.email " +
+				"WHEN NOT MATCHED THEN INSERT (email, name) VALUES (source.email, source.name) OUTPUT INSERTED.id;",
+		},
+		{
+			name:        "mysql insert is selected back",
+			dialect:     DialectMySQL,
+			setup:       func(qb *QueryBuilder) { qb.Insert([]string{"name"}, [][]any{{"John"}}).Returning("id", "name") },
+			expectedSQL: "INSERT INTO users (name) VALUES (?)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qb := QueryFromConn(dialectConn(t, tt.dialect)).Table("users")
+			tt.setup(qb)
+
+			if query, _ := qb.Build(); query != tt.expectedSQL {
+				t.Errorf("Expected %q, got %q", tt.expectedSQL, query)
+			}
+		})
+	}
+
+	var users []User
+	err := QueryFromConn(dialectConn(t, DialectMySQL)).Table("users").
+		Delete().Where(EQ("id", 1)).Returning("id").
+		ScanAll(context.Background(), &users)
+	if !errors.Is(err, ErrReturningNotSupported) {
+		t.Errorf("Expected ErrReturningNotSupported, got %v", err)
+	}
+}
+
+func TestReturning(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	var inserted []User
+	err := QueryFromConn(conn).Table("users").
+		Insert([]string{"name", "created_at"}, [][]any{{"John Doe", time.Now()}, {"Jane Doe", time.Now()}}).
+		Returning("id", "name", "created_at").
+		ScanAll(ctx, &inserted)
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if len(inserted) != 2 || inserted[0].ID == 0 || inserted[1].Name != "Jane Doe" {
+		t.Errorf("Expected the inserted users with their ids, got %+v", inserted)
+	}
+
+	var id uint64
+	err = QueryFromConn(conn).Table("users").
+		Update(map[string]any{"name": "John Smith"}).
+		Where(EQ("name", "John Doe")).
+		Returning("id").
+		Scan(ctx, &id)
+	if err != nil || id != inserted[0].ID {
+		t.Errorf("Expected the id %d of the updated user, got %d (%v)", inserted[0].ID, id, err)
+	}
+
+	var deleted User
+	err = QueryFromConn(conn).Table("users").
+		Delete().
+		Where(EQ("id", inserted[1].ID)).
+		Returning("id", "name", "created_at").
+		Scan(ctx, &deleted)
+	if err != nil || deleted.Name != "Jane Doe" {
+		t.Errorf("Expected the deleted user, got %+v (%v)", deleted, err)
+	}
+}
+
+// insertResult is the result of an INSERT served without a database
+type insertResult int64
+
+func (r insertResult) LastInsertId() (int64, error) { return int64(r), nil }
+func (r insertResult) RowsAffected() (int64, error) { return 2, nil }
+
+func TestReturningMySQL(t *testing.T) {
+	conn := dialectConn(t, DialectMySQL)
+	var statements []string
+	var args []any
+	conn.Use(func(next QueryHandler) QueryHandler {
+		return func(ctx context.Context, s *Statement) error {
+			statements = append(statements, s.SQL)
+			switch {
+			case s.Op == OpExec:
+				s.Result = insertResult(7)
+			case s.Op == OpGet:
+				*s.Dest.(*int64) = 2
+			default:
+				args = s.Args
+			}
+			return nil
+		}
+	})
+
+	var ids []int64
+	err := QueryFromConn(conn).Table("accounts").
+		Insert([]string{"name"}, [][]any{{"John"}, {"Jane"}}).
+		Returning("account_id").
+		ReturningKey("account_id").
+		ScanAll(context.Background(), &ids)
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	expected := []string{
+		"INSERT INTO accounts (name) VALUES (?), (?)",
+		"SELECT @@auto_increment_increment",
+		"SELECT account_id FROM accounts WHERE account_id IN (?, ?) ORDER BY account_id",
+	}
+	if fmt.Sprint(statements) != fmt.Sprint(expected) {
+		t.Errorf("Expected %q, got %q", expected, statements)
+	}
+	if fmt.Sprint(args) != "[7 9]" {
+		t.Errorf("Expected the keys to step by the auto-increment increment, got %v", args)
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	columns := []string{"id", "name", "created_at"}
+	rows := make([][]any, 2500)
+	ids := make([][]any, len(rows))
+	for i := range rows {
+		rows[i] = []any{i, "name", time.Now()}
+		ids[i] = []any{i}
+	}
+
+	sizes := func(chunks [][][]any) []int {
+		result := make([]int, len(chunks))
+		for i, chunk := range chunks {
+			result[i] = len(chunk)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name     string
+		dialect  string
+		columns  []string
+		rows     [][]any
+		opts     BatchOptions
+		expected []int
+	}{
+		{name: "sqlite", dialect: DialectSQLite, rows: rows, expected: []int{333, 333, 333, 333, 333, 333, 333, 169}},
+		{name: "mssql", dialect: DialectMsSQL, rows: rows, expected: []int{699, 699, 699, 403}},
+		{name: "mssql row limit", dialect: DialectMsSQL, columns: []string{"id"}, rows: ids, expected: []int{1000, 1000, 500}},
+		{name: "postgres", dialect: DialectPgSQL, rows: rows, expected: []int{2500}},
+		{name: "chunk size", dialect: DialectPgSQL, rows: rows, opts: BatchOptions{ChunkSize: 1000}, expected: []int{1000, 1000, 500}},
+		{name: "chunk size above the limit", dialect: DialectMsSQL, rows: rows[:1000], opts: BatchOptions{ChunkSize: 900}, expected: []int{699, 301}},
+		{name: "max bytes", dialect: DialectMySQL, rows: rows[:10], opts: BatchOptions{MaxBytes: 100}, expected: []int{3, 3, 3, 1}},
+		{name: "no rows", dialect: DialectSQLite, rows: nil, expected: []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.columns == nil {
+				tt.columns = columns
+			}
+			chunks, err := splitBatch(tt.dialect, tt.columns, tt.rows, tt.opts)
+			if err != nil {
+				t.Fatalf("Failed to split batch: %v", err)
+			}
+			if got := sizes(chunks); fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+				t.Errorf("Expected chunks of %v rows, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	if _, err := splitBatch(DialectSQLite, columns, [][]any{{1, "name"}}, BatchOptions{}); err == nil {
+		t.Errorf("Expected an error for a row with missing values")
+	}
+}
+
+func TestInsertBatch(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	count := func() int {
+		t.Helper()
+		var count int
+		if err := QueryFromConn(conn).Table("users").Select("COUNT(*)").Scan(ctx, &count); err != nil {
+			t.Fatalf("Failed to count users: %v", err)
+		}
+		return count
+	}
+
+	columns := []string{"id", "name", "created_at"}
+	rows := make([][]any, 1000)
+	for i := range rows {
+		rows[i] = []any{i + 1, fmt.Sprintf("User %d", i+1), time.Now()}
+	}
+
+	result, err := QueryFromConn(conn).Table("users").InsertBatch(ctx, columns, rows, BatchOptions{})
+	if err != nil {
+		t.Fatalf("Failed to insert batch: %v", err)
+	}
+	if result.RowsAffected != 1000 || result.Chunks != 4 || count() != 1000 {
+		t.Errorf("Expected 1000 rows in 4 chunks, got %+v and %d rows", result, count())
+	}
+
+	// The third chunk conflicts with the rows inserted above
+	conflicting := make([][]any, 10)
+	for i := range conflicting {
+		id := 1001 + i
+		if i == 7 {
+			id = 1
+		}
+		conflicting[i] = []any{id, "Conflict", time.Now()}
+	}
+
+	for _, tx := range []bool{true, false} {
+		result, err = QueryFromConn(conn).Table("users").InsertBatch(ctx, columns, conflicting, BatchOptions{ChunkSize: 3, Transaction: tx})
+
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) || batchErr.Chunk != 2 || batchErr.Offset != 6 || batchErr.Rows != 3 {
+			t.Fatalf("Expected chunk 2 to fail, got %v", err)
+		}
+
+		expected := 1000
+		if !tx {
+			expected = 1006
+		}
+		if got := count(); got != expected || result.RowsAffected != int64(expected-1000) {
+			t.Errorf("Expected %d rows after the failed batch (transaction: %v), got %d and %+v", expected, tx, got, result)
+		}
+	}
+}
+
+func TestIterate(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	_, err := QueryFromConn(conn).Table("users").Insert([]string{"id", "name", "created_at"}, [][]any{
+		{1, "John Doe", time.Now()},
+		{2, "Jane Doe", time.Now()},
+		{3, "James Doe", time.Now()},
+		{4, "Alice Smith", time.Now()},
+		{5, "Bob Smith", time.Now()},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	users := func() *QueryBuilder {
+		return QueryFromConn(conn).Table("users").Select("id", "name", "created_at").OrderBy("id")
+	}
+
+	var ids []uint64
+	for user, err := range Iterate[User](ctx, users()) {
+		if err != nil {
+			t.Fatalf("Failed to iterate: %v", err)
+		}
+		ids = append(ids, user.ID)
+		if user.ID == 3 {
+			break
+		}
+	}
+	if fmt.Sprint(ids) != "[1 2 3]" {
+		t.Errorf("Expected users 1 to 3, got %v", ids)
+	}
+	if inUse := conn.PoolStats().InUse; inUse != 0 {
+		t.Errorf("Expected the rows to be closed after breaking the loop, got %d connections in use", inUse)
+	}
+
+	var names []string
+	for name, err := range Iterate[string](ctx, QueryFromConn(conn).Table("users").Select("name").Where(Like("name", "%Smith")).OrderBy("id")) {
+		if err != nil {
+			t.Fatalf("Failed to iterate: %v", err)
+		}
+		names = append(names, name)
+	}
+	if fmt.Sprint(names) != "[Alice Smith Bob Smith]" {
+		t.Errorf("Expected the Smiths, got %v", names)
+	}
+
+	for row, err := range Iterate[map[string]any](ctx, users().Limit(1)) {
+		if err != nil || row["name"] != "John Doe" {
+			t.Errorf("Expected John Doe as a map, got %v (%v)", row, err)
+		}
+	}
+
+	for _, err := range Iterate[User](ctx, QueryFromConn(conn).Table("missing").Select("*")) {
+		if err == nil {
+			t.Errorf("Expected the query error to be yielded")
+		}
+	}
+
+	// Each stops on ErrStop without an error and returns the other errors
+	count := 0
+	err = Each(ctx, users(), func(user User) error {
+		count++
+		if count == 2 {
+			return ErrStop
+		}
+		return nil
+	})
+	if err != nil || count != 2 {
+		t.Errorf("Expected Each to stop after 2 users, got %d (%v)", count, err)
+	}
+
+	boom := errors.New("boom")
+	if err := Each(ctx, users(), func(user User) error { return boom }); err != boom {
+		t.Errorf("Expected the error of the callback, got %v", err)
+	}
+
+	// Rows written in a transaction are visible to Each within it
+	err = conn.Transaction(ctx, func(ctx context.Context) error {
+		_, err := QueryFromConn(conn).Table("users").Insert([]string{"id", "name", "created_at"}, [][]any{
+			{6, "Carol Smith", time.Now()},
+		}).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		count = 0
+		return Each(ctx, users(), func(user User) error {
+			count++
+			return nil
+		})
+	})
+	if err != nil || count != 6 {
+		t.Errorf("Expected 6 users within the transaction, got %d (%v)", count, err)
+	}
+}
+
+func TestChunk(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	_, err := QueryFromConn(conn).Table("users").Insert([]string{"id", "name", "created_at"}, [][]any{
+		{1, "John Doe", time.Now()},
+		{2, "Jane Doe", time.Now()},
+		{3, "James Doe", time.Now()},
+		{4, "Alice Smith", time.Now()},
+		{5, "Bob Smith", time.Now()},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	users := func() *QueryBuilder {
+		return QueryFromConn(conn).Table("users").Select("id", "name", "created_at").OrderBy("id")
+	}
+
+	var chunks []string
+	qb := users().Limit(3)
+	err = Chunk(ctx, qb, 2, func(ctx context.Context, users []User) error {
+		var ids []uint64
+		for _, user := range users {
+			ids = append(ids, user.ID)
+		}
+		chunks = append(chunks, fmt.Sprint(ids))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to chunk: %v", err)
+	}
+	if fmt.Sprint(chunks) != "[[1 2] [3 4] [5]]" {
+		t.Errorf("Expected 3 chunks, got %v", chunks)
+	}
+	if qb.limit != 3 || qb.offset != -1 {
+		t.Errorf("Expected the limit and offset of the query to be restored, got %d and %d", qb.limit, qb.offset)
+	}
+
+	boom := errors.New("boom")
+	calls := 0
+	err = Chunk(ctx, users(), 2, func(ctx context.Context, names []map[string]any) error {
+		calls++
+		return boom
+	})
+	if err != boom || calls != 1 {
+		t.Errorf("Expected Chunk to stop at the first error, got %d calls (%v)", calls, err)
+	}
+
+	if err := Chunk(ctx, users(), 0, func(ctx context.Context, users []User) error { return nil }); err == nil {
+		t.Errorf("Expected an error for a chunk size of 0")
+	}
+
+	// ChunkByID walks the rows by key, so deleting them does not skip any
+	chunks = nil
+	err = ChunkByID(ctx, QueryFromConn(conn).Table("users").Select("users.id"), 2, "users.id", func(ctx context.Context, ids []int64) error {
+		chunks = append(chunks, fmt.Sprint(ids))
+		_, err := QueryFromConn(conn).Table("users").Delete().Where(In("id", ids[0])).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to chunk by id: %v", err)
+	}
+	if fmt.Sprint(chunks) != "[[1 2] [3 4] [5]]" {
+		t.Errorf("Expected 3 chunks by id, got %v", chunks)
+	}
+
+	// With Transaction, a failing chunk rolls back only its own changes
+	chunks = nil
+	err = ChunkByID(ctx, QueryFromConn(conn).Table("users").Select("id", "name", "created_at"), 1, "id", func(ctx context.Context, users []User) error {
+		chunks = append(chunks, users[0].Name)
+		if _, err := QueryFromConn(conn).Table("users").Delete().Where(EQ("id", users[0].ID)).Exec(ctx); err != nil {
+			return err
+		}
+		if len(chunks) == 2 {
+			return boom
+		}
+		return nil
+	}, ChunkOptions{Transaction: true})
+	if err != boom {
+		t.Errorf("Expected the error of the second chunk, got %v", err)
+	}
+	if fmt.Sprint(chunks) != "[Jane Doe Alice Smith]" {
+		t.Errorf("Expected 2 chunks, got %v", chunks)
+	}
+
+	var names []string
+	if err := QueryFromConn(conn).Table("users").Select("name").OrderBy("id").ScanAll(ctx, &names); err != nil {
+		t.Fatalf("Failed to select users: %v", err)
+	}
+	if fmt.Sprint(names) != "[Alice Smith]" {
+		t.Errorf("Expected only the second chunk to be rolled back, got %v", names)
+	}
+
+	// ChunkByID fails when the rows do not hold the column
+	err = ChunkByID(ctx, QueryFromConn(conn).Table("users").Select("name"), 1, "id", func(ctx context.Context, users []User) error {
+		return nil
+	})
+	if err == nil {
+		t.Errorf("Expected an error when the column is not in the result")
+	}
+
+	pg := dialectConn(t, DialectPgSQL)
+	query, args := QueryFromConn(pg).Table("users").Select("id").Where(EQ("active", true)).keysetChunkQuery("id", 10, 100)
+	expected := "SELECT * FROM (SELECT id FROM users WHERE active = $1) AS chunk WHERE id > $2 ORDER BY id LIMIT 100"
+	if query != expected || len(args) != 2 {
+		t.Errorf("Expected %q, got %q with %v", expected, query, args)
+	}
+}
+
+func TestAggregates(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	_, err := QueryFromConn(conn).Table("users").Insert([]string{"id", "name", "created_at"}, [][]any{
+		{1, "John Doe", time.Now()},
+		{2, "Jane Doe", time.Now()},
+		{3, "Alice Smith", time.Now()},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert users: %v", err)
+	}
+	_, err = QueryFromConn(conn).Table("posts").Insert([]string{"id", "user_id", "title", "body"}, [][]any{
+		{1, 1, "First", "..."},
+		{2, 1, "Second", "..."},
+		{3, 2, "Third", "..."},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert posts: %v", err)
+	}
+
+	qb := QueryFromConn(conn).Table("users").
+		Select("users.id", "users.name").
+		Where(Like("users.name", "%Doe")).
+		OrderBy("users.id DESC").
+		Limit(1)
+
+	if count, err := qb.Count(ctx); err != nil || count != 2 {
+		t.Errorf("Expected a count of 2, got %d (%v)", count, err)
+	}
+	if sum, err := qb.Sum(ctx, "users.id"); err != nil || sum != 3 {
+		t.Errorf("Expected a sum of 3, got %v (%v)", sum, err)
+	}
+	if avg, err := qb.Avg(ctx, "users.id"); err != nil || avg != 1.5 {
+		t.Errorf("Expected an average of 1.5, got %v (%v)", avg, err)
+	}
+	var minName, maxName string
+	if err := qb.Min(ctx, "users.name", &minName); err != nil || minName != "Jane Doe" {
+		t.Errorf("Expected Jane Doe as min, got %q (%v)", minName, err)
+	}
+	if err := qb.Max(ctx, "users.name", &maxName); err != nil || maxName != "John Doe" {
+		t.Errorf("Expected John Doe as max, got %q (%v)", maxName, err)
+	}
+	if exists, err := qb.Exists(ctx); err != nil || !exists {
+		t.Errorf("Expected rows to exist, got %v (%v)", exists, err)
+	}
+
+	// Pluck and Value keep the order and the limit
+	var names []string
+	if err := qb.Pluck(ctx, "users.name", &names); err != nil || fmt.Sprint(names) != "[Jane Doe]" {
+		t.Errorf("Expected [Jane Doe], got %v (%v)", names, err)
+	}
+	var id int64
+	if err := qb.Value(ctx, "users.id", &id); err != nil || id != 2 {
+		t.Errorf("Expected id 2, got %d (%v)", id, err)
+	}
+
+	// The builder still fetches its rows afterwards
+	var users []User
+	if err := qb.ScanAll(ctx, &users); err != nil || len(users) != 1 || users[0].Name != "Jane Doe" {
+		t.Errorf("Expected the builder to be intact, got %v (%v)", users, err)
+	}
+
+	none := QueryFromConn(conn).Table("users").Where(EQ("name", "Nobody"))
+	if exists, err := none.Exists(ctx); err != nil || exists {
+		t.Errorf("Expected no rows to exist, got %v (%v)", exists, err)
+	}
+	if sum, err := none.Sum(ctx, "id"); err != nil || sum != 0 {
+		t.Errorf("Expected a sum of 0 without rows, got %v (%v)", sum, err)
+	}
+	var missing sql.NullInt64
+	if err := none.Max(ctx, "id", &missing); err != nil || missing.Valid {
+		t.Errorf("Expected a NULL max without rows, got %v (%v)", missing, err)
+	}
+	if err := none.Value(ctx, "id", &id); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows, got %v", err)
+	}
+
+	// Grouped queries are aggregated over their groups
+	grouped := QueryFromConn(conn).Table("posts").
+		Select("user_id", "COUNT(*) AS posts").
+		GroupBy("user_id")
+	if count, err := grouped.Count(ctx); err != nil || count != 2 {
+		t.Errorf("Expected 2 groups, got %d (%v)", count, err)
+	}
+	if avg, err := grouped.Avg(ctx, "posts"); err != nil || avg != 1.5 {
+		t.Errorf("Expected an average of 1.5 posts per user, got %v (%v)", avg, err)
+	}
+	query, _ := grouped.aggregateQuery("MAX", "posts")
+	expected := "SELECT MAX(posts) FROM (SELECT user_id, COUNT(*) AS posts FROM posts GROUP BY user_id) AS t"
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+}
+
+func TestClone(t *testing.T) {
+	conn := dialectConn(t, DialectPgSQL)
+
+	base := QueryFromConn(conn).Table("users").
+		Select("users.id", "users.name").
+		Join("posts", "posts.user_id = users.id").
+		Where(EQ("users.active", true)).
+		GroupBy("users.id", "users.name").
+		Having(GT("COUNT(posts.id)", 1)).
+		OrderBy("users.id").
+		Limit(10)
+	baseSQL := "SELECT users.id, users.name FROM users JOIN posts ON posts.user_id = users.id WHERE users.active = $1 GROUP BY users.id, users.name HAVING COUNT(posts.id) > $2 ORDER BY users.id LIMIT 10"
+
+	clone := base.Clone().
+		Join("comments", "comments.user_id = users.id").
+		Where(EQ("users.role", "admin")).
+		OrderBy("users.name").
+		Limit(5).
+		Offset(5)
+
+	query, args := base.Build()
+	if query != baseSQL || len(args) != 2 {
+		t.Errorf("Expected the original to be untouched, got %q with %v", query, args)
+	}
+
+	query, args = clone.Build()
+	expected := "SELECT users.id, users.name FROM users JOIN posts ON posts.user_id = users.id JOIN comments ON comments.user_id = users.id WHERE users.active = $1 AND users.role = $2 GROUP BY users.id, users.name HAVING COUNT(posts.id) > $3 ORDER BY users.id, users.name LIMIT 5 OFFSET 5"
+	if query != expected || len(args) != 3 {
+		t.Errorf("Expected %q, got %q with %v", expected, query, args)
+	}
+
+	// Changing the original does not change the copy either
+	base.Where(EQ("users.id", 1))
+	if again, _ := clone.Build(); again != expected {
+		t.Errorf("Expected the copy to be untouched, got %q", again)
+	}
+
+	insert := QueryFromConn(conn).Table("users").
+		Insert([]string{"email", "name"}, [][]any{{"john@example.com", "John"}}).
+		OnConflict("email").DoUpdate("name")
+	copied := insert.Clone().DoNothing()
+	copied.insertValues[0][1] = "Jane"
+
+	query, args = insert.Build()
+	expected = "INSERT INTO users (email, name) VALUES ($1, $2) ON CONFLICT (email) DO UPDATE SET name = EXCLUDED.name"
+	if query != expected || args[1] != "John" {
+		t.Errorf("Expected %q with John, got %q with %v", expected, query, args)
+	}
+
+	// A builder only read through GetBuilder is still copied
+	read := QueryFromConn(conn).Table("users").Select("*").Where(EQ("id", 1))
+	read.GetBuilder()
+	read.Clone().Where(EQ("x", 2))
+	if query, _ := read.Build(); query != "SELECT * FROM users WHERE id = $1" {
+		t.Errorf("Expected the original to be untouched, got %q", query)
+	}
+
+	// Conditions rendered on it cannot be replayed, so the copy is rejected
+	rendered := QueryFromConn(conn).Table("users").Select("*")
+	rendered.Where(And(Equal("id", 1)(rendered.GetBuilder())))
+	extended := rendered.Clone().Where(EQ("x", 2))
+	query, args = rendered.Build()
+	if query != "SELECT * FROM users WHERE (id = $1)" || len(args) != 1 {
+		t.Errorf("Expected the original to be untouched, got %q with %v", query, args)
+	}
+	if _, err := extended.Exec(context.Background()); !errors.Is(err, ErrCloneNotSupported) {
+		t.Errorf("Expected ErrCloneNotSupported, got %v", err)
+	}
+}
+
+func TestImmutable(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	_, err := QueryFromConn(conn).Table("users").Insert([]string{"id", "name", "created_at"}, [][]any{
+		{1, "John Doe", time.Now()},
+		{2, "Jane Doe", time.Now()},
+		{3, "Alice Smith", time.Now()},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	users := QueryFromConn(conn).Table("users").Select("id", "name", "created_at").Immutable()
+	does := users.Where(Like("name", "%Doe"))
+	if does == users {
+		t.Fatalf("Expected a chained method to return a new builder")
+	}
+	does.OrderBy("id DESC").Limit(1)
+
+	query, _ := users.Build()
+	if expected := "SELECT id, name, created_at FROM users"; query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+	query, _ = does.Build()
+	if expected := "SELECT id, name, created_at FROM users WHERE name LIKE ?"; query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+
+	var page []User
+	if _, err := users.Paginate(ctx, 1, 2, &page); err != nil || len(page) != 2 {
+		t.Errorf("Expected a page of 2 users, got %v (%v)", page, err)
+	}
+	if users.limit != -1 || users.offset != -1 {
+		t.Errorf("Expected Paginate to leave the builder untouched, got limit %d and offset %d", users.limit, users.offset)
+	}
+
+	// A shared immutable base query can be extended and run concurrently
+	var wg sync.WaitGroup
+	errs := make(chan error, 30)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+
+			var user User
+			err := users.Where(EQ("id", id%3+1)).Scan(ctx, &user)
+			if err == nil && user.ID != uint64(id%3+1) {
+				err = fmt.Errorf("expected user %d, got %d", id%3+1, user.ID)
+			}
+			errs <- err
+
+			count, err := does.Count(ctx)
+			if err == nil && count != 2 {
+				err = fmt.Errorf("expected 2 users, got %d", count)
+			}
+			errs <- err
+
+			var names []string
+			errs <- users.OrderBy("name").Pluck(ctx, "name", &names)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestJoins(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialect  string
+		query    func(*QueryBuilder) *QueryBuilder
+		expected string
+		args     []any
+		err      error
+	}{
+		{
+			name:    "left join with bound conditions",
+			dialect: DialectPgSQL,
+			query: func(qb *QueryBuilder) *QueryBuilder {
+				return qb.LeftJoin("posts", On("posts.user_id", "=", "users.id"), EQ("posts.published", true)).
+					Where(EQ("users.active", true))
+			},
+			expected: "SELECT users.name FROM users LEFT JOIN posts ON posts.user_id = users.id AND posts.published = $1 WHERE users.active = $2",
+			args:     []any{true, true},
+		},
+		{
+			name:    "right, full and cross joins",
+			dialect: DialectMsSQL,
+			query: func(qb *QueryBuilder) *QueryBuilder {
+				return qb.RightJoin("posts", On("posts.user_id", "=", "users.id")).
+					FullJoin("teams", On("teams.id", "=", "users.team_id"), NE("teams.name", "staff")).
+					CrossJoin("settings")
+			},
+			expected: "SELECT users.name FROM users RIGHT JOIN posts ON posts.user_id = users.id FULL JOIN teams ON teams.id = users.team_id AND teams.name <> @p1 CROSS JOIN settings",
+			args:     []any{"staff"},
+		},
+		{
+			name:    "subquery join numbering",
+			dialect: DialectPgSQL,
+			query: func(qb *QueryBuilder) *QueryBuilder {
+				counts := QueryFromConn(qb.conn).Table("posts").
+					Select("user_id", "COUNT(*) AS posts").
+					Where(EQ("published", true)).
+					GroupBy("user_id")
+				return qb.Where(EQ("users.active", true)).
+					JoinSub(counts, "counts", On("counts.user_id", "=", "users.id"), GT("counts.posts", 5)).
+					Where(EQ("users.role", "admin"))
+			},
+			expected: "SELECT users.name FROM users JOIN (SELECT user_id, COUNT(*) AS posts FROM posts WHERE published = $1 GROUP BY user_id) AS counts ON counts.user_id = users.id AND counts.posts > $2 WHERE users.active = $3 AND users.role = $4",
+			args:     []any{true, 5, true, "admin"},
+		},
+		{
+			name:    "left subquery join on mssql",
+			dialect: DialectMsSQL,
+			query: func(qb *QueryBuilder) *QueryBuilder {
+				latest := QueryFromConn(qb.conn).Table("logins").Select("user_id", "MAX(at) AS at").Where(GT("at", "2024-01-01")).GroupBy("user_id")
+				return qb.Where(EQ("users.active", true)).LeftJoinSub(latest, "latest", On("latest.user_id", "=", "users.id"))
+			},
+			expected: "SELECT users.name FROM users LEFT JOIN (SELECT user_id, MAX(at) AS at FROM logins WHERE at > @p1 GROUP BY user_id) AS latest ON latest.user_id = users.id WHERE users.active = @p2",
+			args:     []any{"2024-01-01", true},
+		},
+		{
+			name:    "full join on mysql",
+			dialect: DialectMySQL,
+			query: func(qb *QueryBuilder) *QueryBuilder {
+				return qb.FullJoin("posts", On("posts.user_id", "=", "users.id"))
+			},
+			err: ErrJoinNotSupported,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialectConn(t, tt.dialect)
+			qb := tt.query(QueryFromConn(conn).Table("users").Select("users.name"))
+			if tt.err != nil {
+				var rows []string
+				if err := qb.ScanAll(context.Background(), &rows); !errors.Is(err, tt.err) {
+					t.Errorf("Expected %v, got %v", tt.err, err)
+				}
+				return
+			}
+
+			// Building twice, and from a copy, gives the same query
+			for _, qb := range []*QueryBuilder{qb, qb, qb.Clone()} {
+				query, args := qb.Build()
+				if query != tt.expected {
+					t.Errorf("Expected %q, got %q", tt.expected, query)
+				}
+				if fmt.Sprint(args) != fmt.Sprint(tt.args) {
+					t.Errorf("Expected args %v, got %v", tt.args, args)
+				}
+			}
+		})
+	}
+}
+
+func TestJoinsSQLite(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	_, err := QueryFromConn(conn).Table("users").Insert([]string{"id", "name", "created_at"}, [][]any{
+		{1, "John Doe", time.Now()},
+		{2, "Jane Doe", time.Now()},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert users: %v", err)
+	}
+	_, err = QueryFromConn(conn).Table("posts").Insert([]string{"id", "user_id", "title", "body"}, [][]any{
+		{1, 1, "First", "..."},
+		{2, 1, "Draft", "..."},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert posts: %v", err)
+	}
+
+	var rows []struct {
+		Name  string         `db:"name"`
+		Title sql.NullString `db:"title"`
+	}
+	err = QueryFromConn(conn).Table("users").
+		Select("users.name", "posts.title").
+		LeftJoin("posts", On("posts.user_id", "=", "users.id"), NE("posts.title", "Draft")).
+		OrderBy("users.id").
+		ScanAll(ctx, &rows)
+	if err != nil {
+		t.Fatalf("Failed to left join: %v", err)
+	}
+	if len(rows) != 2 || rows[0].Title.String != "First" || rows[1].Title.Valid {
+		t.Errorf("Expected John with his post and Jane without any, got %+v", rows)
+	}
+
+	for _, qb := range []*QueryBuilder{
+		QueryFromConn(conn).Table("users").Select("*").RightJoin("posts", On("posts.user_id", "=", "users.id")),
+		QueryFromConn(conn).Table("users").Select("*").FullJoin("posts", On("posts.user_id", "=", "users.id")),
+	} {
+		if err := qb.ScanAll(ctx, &rows); !errors.Is(err, ErrJoinNotSupported) {
+			t.Errorf("Expected ErrJoinNotSupported, got %v", err)
+		}
+	}
+}
+
+func TestSubqueries(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialect  string
+		query    func(conn *Connection) *QueryBuilder
+		expected string
+		args     []any
+	}{
+		{
+			name:    "in and not in",
+			dialect: DialectPgSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				authors := QueryFromConn(conn).Table("posts").Select("user_id").Where(EQ("published", true))
+				banned := QueryFromConn(conn).Table("bans").Select("user_id").Where(GT("until", "2024-01-01"))
+				return QueryFromConn(conn).Table("users").Select("id").
+					Where(EQ("active", true), In("id", authors), NotIn("id", banned)).
+					Where(EQ("role", "admin"))
+			},
+			expected: "SELECT id FROM users WHERE active = $1 AND id IN (SELECT user_id FROM posts WHERE published = $2) AND id NOT IN (SELECT user_id FROM bans WHERE until > $3) AND role = $4",
+			args:     []any{true, true, "2024-01-01", "admin"},
+		},
+		{
+			name:    "exists and not exists",
+			dialect: DialectMsSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				posts := QueryFromConn(conn).Table("posts").Select("1").Where(On("posts.user_id", "=", "users.id"), EQ("posts.published", true))
+				bans := QueryFromConn(conn).Table("bans").Select("1").Where(On("bans.user_id", "=", "users.id"))
+				return QueryFromConn(conn).Table("users").Select("id").
+					Where(EQ("active", true), Exists(posts), NotExists(bans))
+			},
+			expected: "SELECT id FROM users WHERE active = @p1 AND EXISTS (SELECT 1 FROM posts WHERE posts.user_id = users.id AND posts.published = @p2) AND NOT EXISTS (SELECT 1 FROM bans WHERE bans.user_id = users.id)",
+			args:     []any{true, true},
+		},
+		{
+			name:    "any and all",
+			dialect: DialectPgSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				scores := QueryFromConn(conn).Table("scores").Select("score").Where(EQ("season", 2024))
+				return QueryFromConn(conn).Table("players").Select("name").
+					Where(Any("score", "=", scores), All("score", ">=", QueryFromConn(conn).Table("thresholds").Select("min").Where(EQ("level", 3))))
+			},
+			expected: "SELECT name FROM players WHERE score = ANY (SELECT score FROM scores WHERE season = $1) AND score >= ALL (SELECT min FROM thresholds WHERE level = $2)",
+			args:     []any{2024, 3},
+		},
+		{
+			name:    "select column",
+			dialect: DialectMsSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				posts := QueryFromConn(conn).Table("posts").Select("COUNT(*)").Where(On("posts.user_id", "=", "users.id"), EQ("posts.published", true))
+				return QueryFromConn(conn).Table("users").Select("users.name").SelectSub(posts, "posts").Where(EQ("users.active", true))
+			},
+			expected: "SELECT users.name, (SELECT COUNT(*) FROM posts WHERE posts.user_id = users.id AND posts.published = @p1) AS posts FROM users WHERE users.active = @p2",
+			args:     []any{true, true},
+		},
+		{
+			name:    "from subquery",
+			dialect: DialectPgSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				totals := QueryFromConn(conn).Table("orders").Select("user_id", "SUM(amount) AS total").Where(EQ("status", "paid")).GroupBy("user_id")
+				return QueryFromConn(conn).FromSub(totals, "totals").Select("user_id", "total").Where(GT("total", 100)).OrderBy("total DESC")
+			},
+			expected: "SELECT user_id, total FROM (SELECT user_id, SUM(amount) AS total FROM orders WHERE status = $1 GROUP BY user_id) AS totals WHERE total > $2 ORDER BY total DESC",
+			args:     []any{"paid", 100},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qb := tt.query(dialectConn(t, tt.dialect))
+			for _, qb := range []*QueryBuilder{qb, qb, qb.Clone()} {
+				query, args := qb.Build()
+				if query != tt.expected {
+					t.Errorf("Expected %q, got %q", tt.expected, query)
+				}
+				if fmt.Sprint(args) != fmt.Sprint(tt.args) {
+					t.Errorf("Expected args %v, got %v", tt.args, args)
+				}
+			}
+		})
+	}
+}
+
+func TestSubqueriesSQLite(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	_, err := QueryFromConn(conn).Table("users").Insert([]string{"id", "name", "created_at"}, [][]any{
+		{1, "John Doe", time.Now()},
+		{2, "Jane Doe", time.Now()},
+		{3, "Alice Smith", time.Now()},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert users: %v", err)
+	}
+	_, err = QueryFromConn(conn).Table("posts").Insert([]string{"id", "user_id", "title", "body"}, [][]any{
+		{1, 1, "First", "..."},
+		{2, 1, "Second", "..."},
+		{3, 3, "Third", "..."},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert posts: %v", err)
+	}
+
+	authors := QueryFromConn(conn).Table("posts").Select("user_id")
+	var names []string
+	err = QueryFromConn(conn).Table("users").Where(In("id", authors), Like("name", "%Doe")).Pluck(ctx, "name", &names)
+	if err != nil || fmt.Sprint(names) != "[John Doe]" {
+		t.Errorf("Expected [John Doe], got %v (%v)", names, err)
+	}
+
+	// Changing the subquery afterwards does not change the query using it
+	qb := QueryFromConn(conn).Table("users").Where(In("id", authors))
+	authors.Where(EQ("title", "Third"))
+	if count, err := qb.Count(ctx); err != nil || count != 2 {
+		t.Errorf("Expected 2 authors, got %d (%v)", count, err)
+	}
+
+	counts := QueryFromConn(conn).Table("posts").Select("user_id", "COUNT(*) AS posts").GroupBy("user_id")
+	avg, err := QueryFromConn(conn).FromSub(counts, "counts").Avg(ctx, "posts")
+	if err != nil || avg != 1.5 {
+		t.Errorf("Expected an average of 1.5 posts, got %v (%v)", avg, err)
+	}
+
+	var rows []struct {
+		Name  string `db:"name"`
+		Posts int    `db:"posts"`
+	}
+	posts := QueryFromConn(conn).Table("posts").Select("COUNT(*)").Where(On("posts.user_id", "=", "users.id"))
+	err = QueryFromConn(conn).Table("users").Select("users.name").SelectSub(posts, "posts").OrderBy("users.id").ScanAll(ctx, &rows)
+	if err != nil || len(rows) != 3 || rows[0].Posts != 2 || rows[1].Posts != 0 {
+		t.Errorf("Expected the post counts of the users, got %+v (%v)", rows, err)
+	}
+}
+
+func TestCTEs(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialect  string
+		query    func(conn *Connection) *QueryBuilder
+		expected string
+		args     []any
+	}{
+		{
+			name:    "select",
+			dialect: DialectPgSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				totals := QueryFromConn(conn).Table("orders").Select("user_id", "SUM(amount) AS total").Where(EQ("status", "paid")).GroupBy("user_id")
+				return QueryFromConn(conn).With("totals", totals).Table("totals").Select("user_id").Where(GT("total", 100))
+			},
+			expected: "WITH totals AS (SELECT user_id, SUM(amount) AS total FROM orders WHERE status = $1 GROUP BY user_id) SELECT user_id FROM totals WHERE total > $2",
+			args:     []any{"paid", 100},
+		},
+		{
+			name:    "several",
+			dialect: DialectMsSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				active := QueryFromConn(conn).Table("users").Select("id").Where(EQ("active", true))
+				recent := QueryFromConn(conn).Table("posts").Select("user_id").Where(GT("created_at", "2024-01-01"))
+				return QueryFromConn(conn).With("active", active).With("recent(id)", recent).
+					Table("active").Select("id").Where(In("id", QueryFromConn(conn).Table("recent").Select("id")))
+			},
+			expected: "WITH active AS (SELECT id FROM users WHERE active = @p1), recent(id) AS (SELECT user_id FROM posts WHERE created_at > @p2) SELECT id FROM active WHERE id IN (SELECT id FROM recent)",
+			args:     []any{true, "2024-01-01"},
+		},
+		{
+			name:    "recursive",
+			dialect: DialectPgSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				anchor := QueryFromConn(conn).Table("categories").Select("id", "parent_id").Where(EQ("id", 1))
+				children := QueryFromConn(conn).Table("categories").Select("categories.id", "categories.parent_id").
+					Join("tree", "tree.id = categories.parent_id").Where(EQ("categories.active", true))
+				return QueryFromConn(conn).WithRecursive("tree(id, parent_id)", anchor, children).Table("tree").Select("id").Where(NE("id", 1))
+			},
+			expected: "WITH RECURSIVE tree(id, parent_id) AS (SELECT id, parent_id FROM categories WHERE id = $1 UNION ALL SELECT categories.id, categories.parent_id FROM categories JOIN tree ON tree.id = categories.parent_id WHERE categories.active = $2) SELECT id FROM tree WHERE id <> $3",
+			args:     []any{1, true, 1},
+		},
+		{
+			name:    "recursive on sql server",
+			dialect: DialectMsSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				anchor := QueryFromConn(conn).Table("categories").Select("id", "parent_id").Where(EQ("id", 1))
+				children := QueryFromConn(conn).Table("categories").Select("categories.id", "categories.parent_id").
+					Join("tree", "tree.id = categories.parent_id")
+				return QueryFromConn(conn).WithRecursive("tree(id, parent_id)", anchor, children).Table("tree").Select("id")
+			},
+			expected: "WITH tree(id, parent_id) AS (SELECT id, parent_id FROM categories WHERE id = @p1 UNION ALL SELECT categories.id, categories.parent_id FROM categories JOIN tree ON tree.id = categories.parent_id) SELECT id FROM tree",
+			args:     []any{1},
+		},
+		{
+			name:    "update",
+			dialect: DialectPgSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				inactive := QueryFromConn(conn).Table("users").Select("id").Where(LT("last_login", "2023-01-01"))
+				return QueryFromConn(conn).With("inactive", inactive).Table("users").
+					Update(map[string]any{"active": false}).
+					Where(In("id", QueryFromConn(conn).Table("inactive").Select("id")))
+			},
+			expected: "WITH inactive AS (SELECT id FROM users WHERE last_login < $1) UPDATE users SET active = $2 WHERE id IN (SELECT id FROM inactive)",
+			args:     []any{"2023-01-01", false},
+		},
+		{
+			name:    "delete",
+			dialect: DialectMsSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				spam := QueryFromConn(conn).Table("posts").Select("id").Where(EQ("flagged", true))
+				return QueryFromConn(conn).Table("comments").Delete().With("spam", spam).
+					Where(In("post_id", QueryFromConn(conn).Table("spam").Select("id")), EQ("approved", false))
+			},
+			expected: "WITH spam AS (SELECT id FROM posts WHERE flagged = @p1) DELETE FROM comments WHERE post_id IN (SELECT id FROM spam) AND approved = @p2",
+			args:     []any{true, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qb := tt.query(dialectConn(t, tt.dialect))
+			for _, qb := range []*QueryBuilder{qb, qb, qb.Clone()} {
+				query, args := qb.Build()
+				if query != tt.expected {
+					t.Errorf("Expected %q, got %q", tt.expected, query)
+				}
+				if fmt.Sprint(args) != fmt.Sprint(tt.args) {
+					t.Errorf("Expected args %v, got %v", tt.args, args)
+				}
+			}
+		})
+	}
+}
+
+func TestCTEsSQLite(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	_, err := conn.GetDB().Exec(`CREATE TABLE categories (id INTEGER PRIMARY KEY, parent_id INTEGER, name TEXT NOT NULL)`)
+	if err != nil {
+		t.Fatalf("Failed to create categories: %v", err)
+	}
+	_, err = QueryFromConn(conn).Table("categories").Insert([]string{"id", "parent_id", "name"}, [][]any{
+		{1, nil, "Books"},
+		{2, 1, "Fiction"},
+		{3, 2, "Fantasy"},
+		{4, nil, "Music"},
+		{5, 4, "Jazz"},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert categories: %v", err)
+	}
+
+	anchor := QueryFromConn(conn).Table("categories").Select("id", "name").Where(EQ("id", 1))
+	children := QueryFromConn(conn).Table("categories").Select("categories.id", "categories.name").
+		Join("tree", "tree.id = categories.parent_id")
+	tree := QueryFromConn(conn).WithRecursive("tree(id, name)", anchor, children).Table("tree")
+
+	var names []string
+	if err := tree.OrderBy("id").Pluck(ctx, "name", &names); err != nil || fmt.Sprint(names) != "[Books Fiction Fantasy]" {
+		t.Errorf("Expected [Books Fiction Fantasy], got %v (%v)", names, err)
+	}
+	if count, err := tree.Count(ctx); err != nil || count != 3 {
+		t.Errorf("Expected 3 categories, got %d (%v)", count, err)
+	}
+	if count, err := tree.Clone().Select("name").GroupBy("name").Count(ctx); err != nil || count != 3 {
+		t.Errorf("Expected 3 groups, got %d (%v)", count, err)
+	}
+
+	var chunks [][]string
+	err = ChunkByID(ctx, tree.Clone().Select("id", "name"), 2, "id", func(ctx context.Context, chunk []map[string]any) error {
+		var names []string
+		for _, row := range chunk {
+			names = append(names, fmt.Sprint(row["name"]))
+		}
+		chunks = append(chunks, names)
+		return nil
+	})
+	if err != nil || fmt.Sprint(chunks) != "[[Books Fiction] [Fantasy]]" {
+		t.Errorf("Expected 2 chunks of the tree, got %v (%v)", chunks, err)
+	}
+
+	music := QueryFromConn(conn).Table("categories").Select("id").Where(EQ("name", "Music"))
+	_, err = QueryFromConn(conn).With("music", music).Table("categories").
+		Delete().Where(In("parent_id", QueryFromConn(conn).Table("music").Select("id"))).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to delete with a CTE: %v", err)
+	}
+	if count, err := QueryFromConn(conn).Table("categories").Count(ctx); err != nil || count != 4 {
+		t.Errorf("Expected 4 categories left, got %d (%v)", count, err)
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialect  string
+		query    func(conn *Connection) *QueryBuilder
+		expected string
+		args     []any
+	}{
+		{
+			name:    "union",
+			dialect: DialectPgSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				admins := QueryFromConn(conn).Table("admins").Select("name").Where(EQ("role", "owner"))
+				return QueryFromConn(conn).Table("users").Select("name").Where(EQ("active", true)).
+					Union(admins).OrderBy("name").Limit(10).Offset(20)
+			},
+			expected: "SELECT * FROM ((SELECT name FROM users WHERE active = $1) UNION (SELECT name FROM admins WHERE role = $2)) AS combined ORDER BY name LIMIT 10 OFFSET 20",
+			args:     []any{true, "owner"},
+		},
+		{
+			name:    "union all and except",
+			dialect: DialectMsSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				authors := QueryFromConn(conn).Table("posts").Select("user_id").Where(EQ("published", true))
+				commenters := QueryFromConn(conn).Table("comments").Select("user_id")
+				banned := QueryFromConn(conn).Table("bans").Select("user_id").Where(GT("until", "2024-01-01"))
+				return QueryFromConn(conn).Table("users").Select("id").Where(EQ("active", true)).
+					UnionAll(authors, commenters).Except(banned).OrderBy("id").Limit(5)
+			},
+			expected: "SELECT * FROM ((SELECT id FROM users WHERE active = @p1) UNION ALL (SELECT user_id FROM posts WHERE published = @p2) UNION ALL (SELECT user_id FROM comments) EXCEPT (SELECT user_id FROM bans WHERE until > @p3)) AS combined ORDER BY id OFFSET 0 ROWS FETCH NEXT 5 ROWS ONLY",
+			args:     []any{true, true, "2024-01-01"},
+		},
+		{
+			name:    "intersect with a cte",
+			dialect: DialectPgSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				active := QueryFromConn(conn).Table("users").Select("id").Where(EQ("active", true))
+				authors := QueryFromConn(conn).Table("posts").Select("user_id").OrderBy("created_at DESC").Limit(100)
+				return QueryFromConn(conn).With("active", active).Table("active").Select("id").Intersect(authors)
+			},
+			expected: "WITH active AS (SELECT id FROM users WHERE active = $1) SELECT * FROM ((SELECT id FROM active) INTERSECT (SELECT user_id FROM posts ORDER BY created_at DESC LIMIT 100)) AS combined",
+			args:     []any{true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qb := tt.query(dialectConn(t, tt.dialect))
+			for _, qb := range []*QueryBuilder{qb, qb, qb.Clone()} {
+				query, args := qb.Build()
+				if query != tt.expected {
+					t.Errorf("Expected %q, got %q", tt.expected, query)
+				}
+				if fmt.Sprint(args) != fmt.Sprint(tt.args) {
+					t.Errorf("Expected args %v, got %v", tt.args, args)
+				}
+			}
+		})
+	}
+
+	t.Run("mysql", func(t *testing.T) {
+		conn := dialectConn(t, DialectMySQL)
+		others := QueryFromConn(conn).Table("admins").Select("name")
+
+		query, _ := QueryFromConn(conn).Table("users").Select("name").Union(others).Build()
+		expected := "SELECT * FROM ((SELECT name FROM users) UNION (SELECT name FROM admins)) AS combined"
+		if query != expected {
+			t.Errorf("Expected %q, got %q", expected, query)
+		}
+
+		for _, qb := range []*QueryBuilder{
+			QueryFromConn(conn).Table("users").Select("name").Intersect(others),
+			QueryFromConn(conn).Table("users").Select("name").Except(others),
+		} {
+			var names []string
+			if err := qb.ScanAll(context.Background(), &names); !errors.Is(err, ErrSetOperationNotSupported) {
+				t.Errorf("Expected ErrSetOperationNotSupported, got %v", err)
+			}
+		}
+
+		for version, supported := range map[string]bool{"8.0.30": false, "8.0.31": true, "8.4.2-log": true, "5.7": false} {
+			conn.Config.ServerVersion = version
+			_, err := QueryFromConn(conn).Table("users").Select("name").Intersect(others).Exec(context.Background())
+			if errors.Is(err, ErrSetOperationNotSupported) == supported {
+				t.Errorf("Expected INTERSECT to be supported on %s: %v, got %v", version, supported, err)
+			}
+		}
+		conn.Config.ServerVersion = "8.0.31"
+		query, _ = QueryFromConn(conn).Table("users").Select("name").Except(others).Build()
+		expected = "SELECT * FROM ((SELECT name FROM users) EXCEPT (SELECT name FROM admins)) AS combined"
+		if query != expected {
+			t.Errorf("Expected %q, got %q", expected, query)
+		}
+	})
+}
+
+func TestSetOperationsSQLite(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	_, err := QueryFromConn(conn).Table("users").Insert([]string{"id", "name", "created_at"}, [][]any{
+		{1, "John Doe", time.Now()},
+		{2, "Jane Doe", time.Now()},
+		{3, "Alice Smith", time.Now()},
+		{4, "Bob Brown", time.Now()},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert users: %v", err)
+	}
+	_, err = QueryFromConn(conn).Table("posts").Insert([]string{"id", "user_id", "title", "body"}, [][]any{
+		{1, 1, "First", "..."},
+		{2, 3, "Second", "..."},
+		{3, 3, "Third", "..."},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert posts: %v", err)
+	}
+
+	does := QueryFromConn(conn).Table("users").Select("id").Where(Like("name", "%Doe"))
+	authors := QueryFromConn(conn).Table("posts").Select("user_id")
+
+	var ids []int64
+	err = does.Clone().UnionAll(authors).OrderBy("id DESC").Limit(3).ScanAll(ctx, &ids)
+	if err != nil || fmt.Sprint(ids) != "[3 3 2]" {
+		t.Errorf("Expected [3 3 2], got %v (%v)", ids, err)
+	}
+
+	union := does.Clone().Union(authors)
+	if count, err := union.Count(ctx); err != nil || count != 3 {
+		t.Errorf("Expected 3 ids, got %d (%v)", count, err)
+	}
+	if sum, err := union.Sum(ctx, "id"); err != nil || sum != 6 {
+		t.Errorf("Expected a sum of 6, got %v (%v)", sum, err)
+	}
+
+	ids = nil
+	if err := does.Clone().Intersect(authors).ScanAll(ctx, &ids); err != nil || fmt.Sprint(ids) != "[1]" {
+		t.Errorf("Expected [1], got %v (%v)", ids, err)
+	}
+	ids = nil
+	if err := does.Clone().Except(authors).ScanAll(ctx, &ids); err != nil || fmt.Sprint(ids) != "[2]" {
+		t.Errorf("Expected [2], got %v (%v)", ids, err)
+	}
+
+	p, err := does.Clone().Union(authors).OrderBy("id").Paginate(ctx, 2, 2, &ids)
+	if err != nil || p.Total != 3 || fmt.Sprint(ids) != "[3]" {
+		t.Errorf("Expected the second page [3] of 3 ids, got %v (%v)", ids, err)
+	}
+
+	// SQLite would apply the ORDER BY and LIMIT of a member to the whole compound
+	for _, member := range []*QueryBuilder{authors.Clone().OrderBy("user_id"), authors.Clone().Limit(1)} {
+		ids = nil
+		if err := does.Clone().Union(member).ScanAll(ctx, &ids); !errors.Is(err, ErrSetOperationNotSupported) {
+			t.Errorf("Expected ErrSetOperationNotSupported, got %v (%v)", err, ids)
+		}
+	}
+}
+
+func TestWindowFunctions(t *testing.T) {
+	ranked := func(conn *Connection) *QueryBuilder {
+		return QueryFromConn(conn).Table("employees").
+			SelectExpr("name", RowNumber().Over(Window().PartitionBy("department").OrderBy("salary DESC")).As("position")).
+			Where(EQ("active", true))
+	}
+	running := func(conn *Connection) *QueryBuilder {
+		return QueryFromConn(conn).Table("payments").
+			SelectExpr("id",
+				SumOver("amount").OverWindow("w").As("total"),
+				Lag("amount", 1, 0).OverWindow("w").As("previous"),
+				AvgOver("amount").Over(Window().PartitionBy("user_id")).As("average")).
+			Window("w", Window().PartitionBy("user_id").OrderBy("paid_at").Rows(UnboundedPreceding, CurrentRow)).
+			Where(GT("amount", 10)).
+			OrderByExpr("user_id", Rank().Over(Window().OrderBy("amount DESC"))).
+			Limit(10)
+	}
+
+	tests := []struct {
+		name     string
+		dialect  string
+		query    func(conn *Connection) *QueryBuilder
+		expected string
+		args     []any
+	}{
+		{
+			name:     "ranking on postgres",
+			dialect:  DialectPgSQL,
+			query:    ranked,
+			expected: "SELECT name, ROW_NUMBER() OVER (PARTITION BY department ORDER BY salary DESC) AS position FROM employees WHERE active = $1",
+			args:     []any{true},
+		},
+		{
+			name:     "named window on postgres",
+			dialect:  DialectPgSQL,
+			query:    running,
+			expected: "SELECT id, SUM(amount) OVER w AS total, LAG(amount, 1, $1) OVER w AS previous, AVG(amount) OVER (PARTITION BY user_id) AS average FROM payments WHERE amount > $2 WINDOW w AS (PARTITION BY user_id ORDER BY paid_at ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW) ORDER BY user_id, RANK() OVER (ORDER BY amount DESC) LIMIT 10",
+			args:     []any{0, 10},
+		},
+		{
+			name:     "named window on mysql",
+			dialect:  DialectMySQL,
+			query:    running,
+			expected: "SELECT id, SUM(amount) OVER w AS total, LAG(amount, 1, ?) OVER w AS previous, AVG(amount) OVER (PARTITION BY user_id) AS average FROM payments WHERE amount > ? WINDOW w AS (PARTITION BY user_id ORDER BY paid_at ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW) ORDER BY user_id, RANK() OVER (ORDER BY amount DESC) LIMIT 10",
+			args:     []any{0, 10},
+		},
+		{
+			name:     "named window on sqlite",
+			dialect:  DialectSQLite,
+			query:    running,
+			expected: "SELECT id, SUM(amount) OVER w AS total, LAG(amount, 1, ?) OVER w AS previous, AVG(amount) OVER (PARTITION BY user_id) AS average FROM payments WHERE amount > ? WINDOW w AS (PARTITION BY user_id ORDER BY paid_at ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW) ORDER BY user_id, RANK() OVER (ORDER BY amount DESC) LIMIT 10",
+			args:     []any{0, 10},
+		},
+		{
+			name:     "named window inlined on sql server",
+			dialect:  DialectMsSQL,
+			query:    running,
+			expected: "SELECT id, SUM(amount) OVER (PARTITION BY user_id ORDER BY paid_at ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW) AS total, LAG(amount, 1, @p1) OVER (PARTITION BY user_id ORDER BY paid_at ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW) AS previous, AVG(CAST(amount AS FLOAT)) OVER (PARTITION BY user_id) AS average FROM payments WHERE amount > @p2 ORDER BY user_id, RANK() OVER (ORDER BY amount DESC) OFFSET 0 ROWS FETCH NEXT 10 ROWS ONLY",
+			args:     []any{0, 10},
+		},
+		{
+			name:    "unordered row number on sql server",
+			dialect: DialectMsSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				return QueryFromConn(conn).Table("employees").SelectExpr("name", RowNumber().Over(Window().PartitionBy("department")).As("n"), NTile(4).As("quartile"))
+			},
+			expected: "SELECT name, ROW_NUMBER() OVER (PARTITION BY department ORDER BY (SELECT NULL)) AS n, NTILE(4) OVER (ORDER BY (SELECT NULL)) AS quartile FROM employees",
+		},
+		{
+			name:    "subquery with a window clause",
+			dialect: DialectPgSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				latest := QueryFromConn(conn).Table("posts").
+					SelectExpr("id", "user_id", RowNumber().OverWindow("w").As("n")).
+					Window("w", Window().PartitionBy("user_id").OrderBy("created_at DESC")).
+					Where(EQ("published", true))
+				return QueryFromConn(conn).FromSub(latest, "latest").Select("id").Where(EQ("n", 1)).OrderBy("id")
+			},
+			expected: "SELECT id FROM (SELECT id, user_id, ROW_NUMBER() OVER w AS n FROM posts WHERE published = $1 WINDOW w AS (PARTITION BY user_id ORDER BY created_at DESC)) AS latest WHERE n = $2 ORDER BY id",
+			args:     []any{true, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qb := tt.query(dialectConn(t, tt.dialect))
+			for _, qb := range []*QueryBuilder{qb, qb, qb.Clone()} {
+				query, args := qb.Build()
+				if query != tt.expected {
+					t.Errorf("Expected %q, got %q", tt.expected, query)
+				}
+				if fmt.Sprint(args) != fmt.Sprint(tt.args) {
+					t.Errorf("Expected args %v, got %v", tt.args, args)
+				}
+			}
+		})
+	}
+
+	t.Run("unsupported column", func(t *testing.T) {
+		qb := QueryFromConn(dialectConn(t, DialectPgSQL)).Table("users").SelectExpr("id", 42)
+		var ids []int64
+		if err := qb.ScanAll(context.Background(), &ids); err == nil {
+			t.Error("Expected an error for a column of type int")
+		}
+	})
+}
+
+func TestBuildWithoutSideEffects(t *testing.T) {
+	conn := dialectConn(t, DialectPgSQL)
+	active := QueryFromConn(conn).Table("users").Select("id").Where(EQ("active", true))
+	posts := QueryFromConn(conn).Table("posts").Select("COUNT(*)").Where(On("posts.user_id", "=", "users.id"))
+
+	qb := QueryFromConn(conn).With("active_users", active).
+		Table("users").
+		SelectExpr("id", Lag("name", 1, "").Over(Window().OrderBy("id")).As("previous")).
+		SelectSub(posts, "posts").
+		Where(In("id", QueryFromConn(conn).Table("active_users").Select("id"))).
+		OrderBy("id")
+
+	// The index the next argument of the builder would take
+	next := func() string {
+		probe := *qb.builder.(*BuilderSelect).Args
+		return probe.Add(nil)
+	}
+
+	before := next()
+	query, args := qb.Build()
+	for i := 0; i < 3; i++ {
+		again, againArgs := qb.Build()
+		if again != query || fmt.Sprint(againArgs) != fmt.Sprint(args) {
+			t.Errorf("Expected %q %v, got %q %v", query, args, again, againArgs)
+		}
+	}
+	if after := next(); after != before {
+		t.Errorf("Expected building to add no arguments to the builder, next one went from %s to %s", before, after)
+	}
+}
+
+func TestWindowFunctionsSQLite(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	_, err := QueryFromConn(conn).Table("users").Insert([]string{"id", "name", "created_at"}, [][]any{
+		{1, "John Doe", time.Now()},
+		{2, "Jane Doe", time.Now()},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert users: %v", err)
+	}
+	_, err = QueryFromConn(conn).Table("posts").Insert([]string{"id", "user_id", "title", "body"}, [][]any{
+		{1, 1, "First", "..."},
+		{2, 2, "Second", "..."},
+		{3, 1, "Third", "..."},
+		{4, 1, "Fourth", "..."},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert posts: %v", err)
+	}
+
+	var rows []struct {
+		ID       int64 `db:"id"`
+		Position int64 `db:"position"`
+		Running  int64 `db:"running"`
+		Previous int64 `db:"previous"`
+	}
+	err = QueryFromConn(conn).Table("posts").
+		SelectExpr("id",
+			RowNumber().OverWindow("w").As("position"),
+			SumOver("id").OverWindow("w").As("running"),
+			Lag("id", 1, 0).OverWindow("w").As("previous")).
+		Window("w", Window().PartitionBy("user_id").OrderBy("id").Rows(UnboundedPreceding, CurrentRow)).
+		OrderBy("user_id", "id").
+		ScanAll(ctx, &rows)
+	if err != nil {
+		t.Fatalf("Failed to select window functions: %v", err)
+	}
+	if fmt.Sprint(rows) != "[{1 1 1 0} {3 2 4 1} {4 3 8 3} {2 1 2 0}]" {
+		t.Errorf("Unexpected rows %v", rows)
+	}
+
+	latest := QueryFromConn(conn).Table("posts").
+		SelectExpr("title", "user_id", RowNumber().Over(Window().PartitionBy("user_id").OrderBy("id DESC")).As("n"))
+	var titles []string
+	err = QueryFromConn(conn).FromSub(latest, "latest").Where(EQ("n", 1)).OrderBy("user_id").Pluck(ctx, "title", &titles)
+	if err != nil || fmt.Sprint(titles) != "[Fourth Second]" {
+		t.Errorf("Expected [Fourth Second], got %v (%v)", titles, err)
+	}
+
+	count, err := QueryFromConn(conn).Table("posts").SelectExpr("id", CountOver("*").OverWindow("w").As("n")).
+		Window("w", Window().PartitionBy("user_id")).Count(ctx)
+	if err != nil || count != 4 {
+		t.Errorf("Expected 4 posts, got %d (%v)", count, err)
+	}
+}
+
+func TestIdentifierQuoting(t *testing.T) {
+	reserved := func(conn *Connection) *QueryBuilder {
+		return QueryFromConn(conn).Table("user u").
+			Select("u.id", "u.order AS position", "COUNT(*) AS total").
+			LeftJoin("order", On("order.user_id", "=", "u.id")).
+			Where(EQ("u.key", "a"), In("u.group", 1, 2)).
+			GroupBy("u.id", "u.order").
+			OrderBy("u.order DESC")
+	}
+
+	tests := []struct {
+		name     string
+		dialect  string
+		query    func(conn *Connection) *QueryBuilder
+		expected string
+		args     []any
+	}{
+		{
+			name:     "reserved words on postgres",
+			dialect:  DialectPgSQL,
+			query:    reserved,
+			expected: `SELECT u.id, u."order" AS position, COUNT(*) AS total FROM "user" u LEFT JOIN "order" ON "order".user_id = u.id WHERE u."key" = $1 AND u."group" IN ($2, $3) GROUP BY u.id, u."order" ORDER BY u."order" DESC`,
+			args:     []any{"a", 1, 2},
+		},
+		{
+			name:     "reserved words on mysql",
+			dialect:  DialectMySQL,
+			query:    reserved,
+			expected: "SELECT u.id, u.`order` AS position, COUNT(*) AS total FROM `user` u LEFT JOIN `order` ON `order`.user_id = u.id WHERE u.`key` = ? AND u.`group` IN (?, ?) GROUP BY u.id, u.`order` ORDER BY u.`order` DESC",
+			args:     []any{"a", 1, 2},
+		},
+		{
+			name:     "reserved words on sqlite",
+			dialect:  DialectSQLite,
+			query:    reserved,
+			expected: `SELECT u.id, u."order" AS position, COUNT(*) AS total FROM "user" u LEFT JOIN "order" ON "order".user_id = u.id WHERE u."key" = ? AND u."group" IN (?, ?) GROUP BY u.id, u."order" ORDER BY u."order" DESC`,
+			args:     []any{"a", 1, 2},
+		},
+		{
+			name:     "reserved words on sql server",
+			dialect:  DialectMsSQL,
+			query:    reserved,
+			expected: "SELECT u.id, u.[order] AS position, COUNT(*) AS total FROM [user] u LEFT JOIN [order] ON [order].user_id = u.id WHERE u.[key] = @p1 AND u.[group] IN (@p2, @p3) GROUP BY u.id, u.[order] ORDER BY u.[order] DESC",
+			args:     []any{"a", 1, 2},
+		},
+		{
+			name:    "mixed case reserved words on postgres",
+			dialect: DialectPgSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				return QueryFromConn(conn).Table("User").Select("Order", "Default", "Name").OrderBy("Order DESC")
+			},
+			expected: `SELECT "order", "default", Name FROM "user" ORDER BY "order" DESC`,
+		},
+		{
+			name:    "mixed case reserved words on mysql",
+			dialect: DialectMySQL,
+			query: func(conn *Connection) *QueryBuilder {
+				return QueryFromConn(conn).Table("User").Select("Order", "Default", "Name").OrderBy("Order DESC")
+			},
+			expected: "SELECT `Order`, `Default`, Name FROM `User` ORDER BY `Order` DESC",
+		},
+		{
+			name:    "quoted names are kept",
+			dialect: DialectMySQL,
+			query: func(conn *Connection) *QueryBuilder {
+				return QueryFromConn(conn).Table("`user`").Select("`order`", "DISTINCT name").Where(IsNull("`group`"))
+			},
+			expected: "SELECT `order`, DISTINCT name FROM `user` WHERE `group` IS NULL",
+		},
+		{
+			name:    "raw expressions",
+			dialect: DialectPgSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				return QueryFromConn(conn).Table("users").
+					SelectExpr("id", Raw("COALESCE(nickname, name) AS display")).
+					Where(Raw("LOWER(email) = ?", "john@example.com"), Raw("data ?? 'admin' AND price > $5")).
+					OrderByExpr(Raw("CASE WHEN id = ? THEN 0 ELSE 1 END", 7), "name").
+					Limit(5)
+			},
+			expected: "SELECT id, COALESCE(nickname, name) AS display FROM users WHERE LOWER(email) = $1 AND data ? 'admin' AND price > $5 ORDER BY CASE WHEN id = $2 THEN 0 ELSE 1 END, name LIMIT 5",
+			args:     []any{"john@example.com", 7},
+		},
+		{
+			name:    "update",
+			dialect: DialectMySQL,
+			query: func(conn *Connection) *QueryBuilder {
+				return QueryFromConn(conn).Table("settings").Update(map[string]any{"value": "dark"}).Where(EQ("key", "theme")).OrderBy("key")
+			},
+			expected: "UPDATE settings SET value = ? WHERE `key` = ? ORDER BY `key`",
+			args:     []any{"dark", "theme"},
+		},
+		{
+			name:    "upsert on postgres",
+			dialect: DialectPgSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				return QueryFromConn(conn).Table("settings").
+					Insert([]string{"key", "value"}, [][]any{{"theme", "dark"}}).
+					OnConflict("key").DoUpdate("value").Returning("key")
+			},
+			expected: `INSERT INTO settings ("key", value) VALUES ($1, $2) ON CONFLICT ("key") DO UPDATE SET value = EXCLUDED.value RETURNING "key"`,
+			args:     []any{"theme", "dark"},
+		},
+		{
+			name:    "upsert on sql server",
+			dialect: DialectMsSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				return QueryFromConn(conn).Table("settings").
+					Insert([]string{"key", "value"}, [][]any{{"theme", "dark"}}).
+					OnConflict("key").DoUpdate("value")
+			},
+			expected: "MERGE INTO settings WITH (HOLDLOCK) AS target USING (VALUES (@p1, @p2)) AS source ([key], value) ON target.[key] = source.[key] WHEN MATCHED THEN UPDATE SET target.value = source.value WHEN NOT MATCHED THEN INSERT ([key], value) VALUES (source.[key], source.value);",
+			args:     []any{"theme", "dark"},
+		},
+		{
+			name:    "window on sql server",
+			dialect: DialectMsSQL,
+			query: func(conn *Connection) *QueryBuilder {
+				return QueryFromConn(conn).Table("orders").SelectExpr("id", SumOver("amount").Over(Window().PartitionBy("user").OrderBy("order DESC")).As("total"))
+			},
+			expected: "SELECT id, SUM(amount) OVER (PARTITION BY [user] ORDER BY [order] DESC) AS total FROM orders",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qb := tt.query(dialectConn(t, tt.dialect))
+			for _, qb := range []*QueryBuilder{qb, qb, qb.Clone()} {
+				query, args := qb.Build()
+				if query != tt.expected {
+					t.Errorf("Expected %q, got %q", tt.expected, query)
+				}
+				if fmt.Sprint(args) != fmt.Sprint(tt.args) {
+					t.Errorf("Expected args %v, got %v", tt.args, args)
+				}
+			}
+		})
+	}
+
+	t.Run("quote identifier", func(t *testing.T) {
+		expected := map[string]string{
+			DialectPgSQL:  `"users"."order"."x""y"`,
+			DialectMySQL:  "`users`.`order`.`x\"y`",
+			DialectSQLite: `"users"."order"."x""y"`,
+			DialectMsSQL:  `[users].[order].[x"y]`,
+		}
+		for dialect, want := range expected {
+			if got := QuoteIdentifier(dialect, `users.order.x"y`); got != want {
+				t.Errorf("Expected %s on %s, got %s", want, dialect, got)
+			}
+		}
+		if got := QuoteIdentifier(DialectMsSQL, "a]b.*"); got != "[a]]b].*" {
+			t.Errorf("Expected [a]]b].*, got %s", got)
+		}
+	})
+}
+
+func TestOrderByAllowed(t *testing.T) {
+	conn := dialectConn(t, DialectPgSQL)
+	ctx := context.Background()
+
+	query, _ := QueryFromConn(conn).Table("users").Select("id").
+		OrderByAllowed("name, -created_at,order desc", "name", "created_at", "order").Build()
+	expected := `SELECT id FROM users ORDER BY name, created_at DESC, "order" DESC`
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+
+	query, _ = QueryFromConn(conn).Table("users").Select("id").OrderByAllowed("", "name").Build()
+	if query != "SELECT id FROM users" {
+		t.Errorf("Expected no ORDER BY, got %q", query)
+	}
+
+	for _, sort := range []string{"password", "name; DROP TABLE users", "-name desc", "name sideways"} {
+		var ids []int64
+		err := QueryFromConn(conn).Table("users").Select("id").OrderByAllowed(sort, "name").ScanAll(ctx, &ids)
+		if !errors.Is(err, ErrInvalidOrderBy) {
+			t.Errorf("Expected ErrInvalidOrderBy for %q, got %v", sort, err)
+		}
+	}
+
+	t.Run("order by writes expressions as is", func(t *testing.T) {
+		for _, col := range []string{"LENGTH(name) DESC", "1", "order DESC NULLS LAST"} {
+			qb := QueryFromConn(conn).Table("users").Select("id").OrderBy(col)
+			if _, err := qb.Exec(ctx); errors.Is(err, ErrInvalidOrderBy) {
+				t.Errorf("Expected OrderBy(%q) to be accepted, got %v", col, err)
+			}
+		}
+		query, _ := QueryFromConn(conn).Table("users").Select("id").OrderBy("LENGTH(name) DESC", "order").Build()
+		expected := `SELECT id FROM users ORDER BY LENGTH(name) DESC, "order"`
+		if query != expected {
+			t.Errorf("Expected %q, got %q", expected, query)
+		}
+	})
+}
+
+func TestIdentifierQuotingSQLite(t *testing.T) {
+	conn := setupDb(DialectSQLite)
+	ctx := context.Background()
+
+	_, err := conn.GetDB().Exec(`CREATE TABLE "group" (id INTEGER PRIMARY KEY, "order" INTEGER NOT NULL, "key" TEXT NOT NULL)`)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	defer conn.GetDB().Exec(`DROP TABLE "group"`)
+
+	_, err = QueryFromConn(conn).Table("group").Insert([]string{"id", "order", "key"}, [][]any{
+		{1, 2, "b"},
+		{2, 1, "a"},
+		{3, 3, "c"},
+	}).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to insert rows: %v", err)
+	}
+
+	_, err = QueryFromConn(conn).Table("group").Update(map[string]any{"order": 4}).Where(EQ("key", "c")).Exec(ctx)
+	if err != nil {
+		t.Fatalf("Failed to update rows: %v", err)
+	}
+
+	var keys []string
+	err = QueryFromConn(conn).Table("group g").Where(GT("g.order", 1)).OrderBy("g.order DESC").Pluck(ctx, "key", &keys)
+	if err != nil || fmt.Sprint(keys) != "[c b]" {
+		t.Errorf("Expected [c b], got %v (%v)", keys, err)
+	}
+
+	var total float64
+	total, err = QueryFromConn(conn).Table("group").Sum(ctx, "order")
+	if err != nil || total != 7 {
+		t.Errorf("Expected 7, got %v (%v)", total, err)
+	}
+
+	keys = nil
+	err = QueryFromConn(conn).Table("group").Select("key").
+		OrderByAllowed("-order", "order", "key").
+		Where(Raw(`"order" < ?`, 4)).
+		ScanAll(ctx, &keys)
+	if err != nil || fmt.Sprint(keys) != "[b a]" {
+		t.Errorf("Expected [b a], got %v (%v)", keys, err)
+	}
+}
@@ -0,0 +1,306 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/huandu/go-sqlbuilder"
+)
+
+// ErrInvalidOrderBy is returned when running a query ordered with
+// OrderByAllowed by a malformed sort parameter or a column which is not
+// allowed.
+var ErrInvalidOrderBy = errors.New("invalid ORDER BY column")
+
+// reservedWords are the keywords reserved by at least one of the dialects,
+// which cannot be used as names unless they are quoted. Keywords standing
+// for values, such as NULL or CURRENT_TIMESTAMP, are left out so that they
+// can still be selected as they are.
+var reservedWords = func() map[string]bool {
+	words := map[string]bool{}
+	for _, word := range strings.Fields(`
+		ACCESSIBLE ADD ALL ALTER ANALYSE ANALYZE AND ANY ARRAY AS ASC ASENSITIVE
+		ASYMMETRIC AUTHORIZATION AUTOINCREMENT BACKUP BEFORE BEGIN BETWEEN BIGINT
+		BINARY BLOB BOTH BREAK BROWSE BULK BY CALL CASCADE CASE CAST CHANGE CHAR
+		CHARACTER CHECK CHECKPOINT CLOSE CLUSTERED COLLATE COLLATION COLUMN COMMIT
+		COMPUTE CONCURRENTLY CONDITION CONSTRAINT CONTAINS CONTAINSTABLE CONTINUE
+		CONVERT CREATE CROSS CUBE CUME_DIST CURRENT CURSOR DATABASE DATABASES DBCC
+		DEALLOCATE DECIMAL DECLARE DEFAULT DEFERRABLE DELAYED DELETE DENSE_RANK DENY
+		DESC DESCRIBE DETERMINISTIC DISK DISTINCT DISTINCTROW DISTRIBUTED DIV DO
+		DOUBLE DROP DUAL DUMP EACH ELSE ELSEIF ENCLOSED END ERRLVL ESCAPE ESCAPED EXCEPT
+		EXEC EXECUTE EXISTS EXIT EXPLAIN FETCH FILE FILLFACTOR FIRST_VALUE FLOAT
+		FOR FORCE FOREIGN FREETEXT FREETEXTTABLE FREEZE FROM FULL FULLTEXT FUNCTION
+		GENERATED GET GLOB GOTO GRANT GROUP GROUPING GROUPS HAVING HOLDLOCK
+		IDENTITY IDENTITYCOL IDENTITY_INSERT IF IGNORE ILIKE IN INDEX INDEXED
+		INITIALLY INNER INOUT INSENSITIVE INSERT INT INTEGER INTERSECT INTERVAL
+		INTO IS ISNULL ITERATE JOIN KEY KEYS KILL LAG LAST_VALUE LATERAL LEAD
+		LEADING LEAVE LEFT LIKE LIMIT LINENO LINES LOAD LOCK LONG LOOP MATCH MERGE
+		MOD NATIONAL NATURAL NOCHECK NONCLUSTERED NOT NOTNULL NTH_VALUE NTILE
+		NUMERIC OF OFF OFFSET OFFSETS ON ONLY OPEN OPENDATASOURCE OPENQUERY
+		OPENROWSET OPENXML OPTION OPTIONALLY OR ORDER OUT OUTER OUTFILE OVER
+		OVERLAPS PARTITION PERCENT PERCENT_RANK PIVOT PLACING PLAN PRAGMA
+		PRECISION PRIMARY PRINT PROC PROCEDURE PUBLIC PURGE RAISE RAISERROR RANGE
+		RANK READ READS READTEXT REAL RECONFIGURE RECURSIVE REFERENCES REGEXP
+		REINDEX RELEASE RENAME REPEAT REPLACE REPLICATION REQUIRE RESIGNAL
+		RESTORE RESTRICT RETURN RETURNING REVERT REVOKE RIGHT RLIKE ROLLBACK ROW
+		ROWCOUNT ROWGUIDCOL ROWS ROW_NUMBER RULE SAVE SCHEMA SCHEMAS SECURITYAUDIT
+		SELECT SENSITIVE SEPARATOR SET SETUSER SHOW SHUTDOWN SIGNAL SIMILAR
+		SMALLINT SOME SPATIAL SPECIFIC SQL STARTING STATISTICS STRAIGHT_JOIN
+		SYMMETRIC SYSTEM TABLE TABLESAMPLE TERMINATED TEXTSIZE THEN TINYINT TO TOP
+		TRAILING TRAN TRANSACTION TRIGGER TRUNCATE TSEQUAL UNDO UNION UNIQUE
+		UNLOCK UNPIVOT UNSIGNED UPDATE UPDATETEXT USAGE USE USER USING VACUUM
+		VALUES VARBINARY VARCHAR VARIADIC VARYING VERBOSE VIEW WAITFOR WHEN WHERE
+		WHILE WINDOW WITH WITHIN WRITE WRITETEXT XOR ZEROFILL`) {
+		words[word] = true
+	}
+	return words
+}()
+
+// identifierQuotes returns the characters opening and closing a quoted
+// identifier in the flavor.
+func identifierQuotes(flavor sqlbuilder.Flavor) (string, string) {
+	switch flavor {
+	case sqlbuilder.MySQL:
+		return "`", "`"
+	case sqlbuilder.SQLServer:
+		return "[", "]"
+	default:
+		return `"`, `"`
+	}
+}
+
+// QuoteIdentifier quotes every part of the possibly qualified name, such as
+// a table or a column, with backticks on MySQL, brackets on SQL Server and
+// double quotes otherwise. A trailing * is left as is.
+//
+//	db.QuoteIdentifier(db.DialectMySQL, "users.order") // `users`.`order`
+func QuoteIdentifier(dialect, name string) string {
+	open, close := identifierQuotes(GetFlavorForDialect(dialect))
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		if part != "*" || i < len(parts)-1 {
+			parts[i] = open + strings.ReplaceAll(part, close, close+close) + close
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// quoteName returns the possibly qualified name with its reserved words
+// quoted for the flavor. Parts which are already quoted and a trailing *
+// are kept. ok is false if name is not a name but an expression.
+//
+// Reserved words are folded to the case the flavor gives unquoted names
+// before being quoted, so that the quoted name stays the same: "Order"
+// becomes "order" on PostgreSQL, which folds names to lower case, while the
+// other dialects compare quoted names as they compare unquoted ones.
+func quoteName(flavor sqlbuilder.Flavor, name string) (quoted string, ok bool) {
+	open, close := identifierQuotes(flavor)
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		switch {
+		case part == "*" && i == len(parts)-1 && i > 0:
+		case isQuoted(part, open, close):
+		case isIdentifier(part):
+			if reservedWords[strings.ToUpper(part)] {
+				parts[i] = open + foldName(flavor, part) + close
+			}
+		default:
+			return name, false
+		}
+	}
+	return strings.Join(parts, "."), true
+}
+
+// foldName returns the unquoted name in the case the flavor folds it to
+func foldName(flavor sqlbuilder.Flavor, name string) string {
+	if flavor == sqlbuilder.PostgreSQL {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// isIdentifier returns true if s is an unquoted identifier
+func isIdentifier(s string) bool {
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || r != '$' && !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isQuoted returns true if s is an identifier quoted with open and close
+func isQuoted(s, open, close string) bool {
+	if len(s) < 2 || !strings.HasPrefix(s, open) || !strings.HasSuffix(s, close) {
+		return false
+	}
+	return !strings.Contains(strings.ReplaceAll(s[1:len(s)-1], close+close, ""), close)
+}
+
+// quoteColumn returns the column with its reserved words quoted for the
+// flavor, or as is if it is an expression.
+func quoteColumn(flavor sqlbuilder.Flavor, column string) string {
+	quoted, _ := quoteName(flavor, column)
+	return quoted
+}
+
+// quoteField returns the field of a condition quoted for the flavor of the
+// builder it is added to.
+func quoteField(builder Builder, field string) string {
+	if builder == nil {
+		return field
+	}
+	return quoteColumn(builder.Flavor(), field)
+}
+
+// quoteColumns returns the columns quoted for the flavor
+func quoteColumns(flavor sqlbuilder.Flavor, columns []string) []string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteColumn(flavor, column)
+	}
+	return quoted
+}
+
+// quoteAliased returns a table or a selected column, written as "name",
+// "name alias" or "name AS alias", quoted for the flavor. Anything else is
+// an expression and returned as is, like "DISTINCT name".
+func quoteAliased(flavor sqlbuilder.Flavor, s string) string {
+	fields := strings.Fields(s)
+	switch {
+	case len(fields) == 2 && !slices.Contains([]string{"ALL", "DISTINCT", "DISTINCTROW"}, strings.ToUpper(fields[0])):
+	case len(fields) == 3 && strings.EqualFold(fields[1], "AS"):
+	case len(fields) != 1:
+		return s
+	}
+
+	name, ok := quoteName(flavor, fields[0])
+	if !ok {
+		return s
+	}
+	if len(fields) == 1 {
+		return name
+	}
+	alias, ok := quoteName(flavor, fields[len(fields)-1])
+	if !ok || strings.Contains(fields[len(fields)-1], ".") {
+		return s
+	}
+	fields[0], fields[len(fields)-1] = name, alias
+	return strings.Join(fields, " ")
+}
+
+// quoteOrder returns an ORDER BY column, written as "name", optionally
+// followed by ASC or DESC and by NULLS FIRST or NULLS LAST, quoted for the
+// flavor. ok is false if s is not such a column.
+func quoteOrder(flavor sqlbuilder.Flavor, s string) (string, bool) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return s, false
+	}
+	modifiers := fields[1:]
+	if len(modifiers) > 0 && (strings.EqualFold(modifiers[0], "ASC") || strings.EqualFold(modifiers[0], "DESC")) {
+		modifiers = modifiers[1:]
+	}
+	if len(modifiers) == 2 && strings.EqualFold(modifiers[0], "NULLS") &&
+		(strings.EqualFold(modifiers[1], "FIRST") || strings.EqualFold(modifiers[1], "LAST")) {
+		modifiers = nil
+	}
+	if len(modifiers) > 0 {
+		return s, false
+	}
+
+	name, ok := quoteName(flavor, fields[0])
+	if !ok || strings.HasSuffix(name, "*") {
+		return s, false
+	}
+	fields[0] = name
+	return strings.Join(fields, " "), true
+}
+
+// Raw returns the SQL expression sql, written as is, for the places where
+// names are not wanted, such as function calls or arithmetic. Each ? is
+// replaced by a placeholder bound to the next of args, and ?? by a literal
+// question mark. It can be used as a condition or passed to SelectExpr and
+// OrderByExpr.
+//
+//	db.Query().Table("users").SelectExpr("id", db.Raw("COALESCE(nickname, name) AS display")).
+//		Where(db.Raw("LOWER(email) = ?", email)).
+//		OrderByExpr(db.Raw("LENGTH(name) DESC"))
+//
+// Never pass user input as sql: it is not quoted nor checked.
+func Raw(sql string, args ...any) ConditionFunc {
+	args = subqueries(args)
+	return func(builder Builder) string {
+		var buf strings.Builder
+		next, arg := 0, 0
+		for {
+			i := strings.IndexByte(sql[next:], '?')
+			if i < 0 {
+				buf.WriteString(sqlbuilder.Escape(sql[next:]))
+				break
+			}
+			buf.WriteString(sqlbuilder.Escape(sql[next : next+i]))
+			next += i + 1
+
+			switch {
+			case strings.HasPrefix(sql[next:], "?"):
+				buf.WriteByte('?')
+				next++
+			case arg < len(args):
+				buf.WriteString(builder.(Cond).Var(args[arg]))
+				arg++
+			default:
+				buf.WriteByte('?')
+			}
+		}
+		return buf.String()
+	}
+}
+
+// build returns the SQL of the condition used as an expression
+func (f ConditionFunc) build(qb *QueryBuilder, b Builder) string {
+	return f(b)
+}
+
+// OrderByAllowed orders the query by a sort parameter supplied by the user,
+// like "name,-created_at": a comma separated list of columns, each
+// descending if prefixed by - and optionally followed by ASC or DESC. The
+// query fails with ErrInvalidOrderBy if a column is not one of allowed.
+//
+//	db.Query().Table("users").Select("*").OrderByAllowed(r.URL.Query().Get("sort"), "name", "created_at")
+func (qb *QueryBuilder) OrderByAllowed(sort string, allowed ...string) *QueryBuilder {
+	qb = qb.mutable()
+	for _, item := range strings.Split(sort, ",") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			continue
+		}
+
+		column, desc := fields[0], false
+		if rest, ok := strings.CutPrefix(column, "-"); ok {
+			column, desc = rest, true
+		}
+		switch {
+		case len(fields) == 1:
+		case len(fields) == 2 && !desc && strings.EqualFold(fields[1], "ASC"):
+		case len(fields) == 2 && !desc && strings.EqualFold(fields[1], "DESC"):
+			desc = true
+		default:
+			qb.err = fmt.Errorf("%w: %q", ErrInvalidOrderBy, strings.TrimSpace(item))
+			return qb
+		}
+
+		if !slices.Contains(allowed, column) {
+			qb.err = fmt.Errorf("%w: %q is not allowed", ErrInvalidOrderBy, column)
+			return qb
+		}
+		if desc {
+			column += " DESC"
+		}
+		qb = qb.OrderBy(column)
+	}
+	return qb
+}
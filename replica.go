@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+)
+
+// Balancer picks the replica connection that serves the next read query
+type Balancer interface {
+	Pick(replicas []*Connection) *Connection
+}
+
+// RoundRobinBalancer cycles through the replicas in order
+type RoundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+// Pick returns the next replica in the rotation
+func (b *RoundRobinBalancer) Pick(replicas []*Connection) *Connection {
+	n := b.next.Add(1) - 1
+	return replicas[n%uint64(len(replicas))]
+}
+
+// RandomBalancer picks a random replica for every read
+type RandomBalancer struct{}
+
+// Pick returns a random replica
+func (b *RandomBalancer) Pick(replicas []*Connection) *Connection {
+	return replicas[rand.IntN(len(replicas))]
+}
+
+// LeastInFlightBalancer picks the replica with the fewest queries currently running
+type LeastInFlightBalancer struct{}
+
+// Pick returns the replica with the lowest number of in-flight queries
+func (b *LeastInFlightBalancer) Pick(replicas []*Connection) *Connection {
+	picked := replicas[0]
+	for _, replica := range replicas[1:] {
+		if replica.InFlight() < picked.InFlight() {
+			picked = replica
+		}
+	}
+	return picked
+}
+
+type stickyKey struct{}
+
+// stickyState records the connections that have been written to within a context
+type stickyState struct {
+	mutex   sync.Mutex
+	written map[*Connection]bool
+}
+
+// WithSticky returns a context that remembers writes made through it, so that
+// connections configured with Sticky read from the primary after a write.
+// It is typically called once per incoming request.
+func WithSticky(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(stickyKey{}).(*stickyState); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, stickyKey{}, &stickyState{written: make(map[*Connection]bool)})
+}
+
+// openReplicas opens a connection for every replica config of the
+// connection. The configs are copied before the defaults are filled in.
+func (c *Connection) openReplicas() error {
+	for _, replicaConfig := range c.Config.Replicas {
+		config := *replicaConfig
+		if config.ConnName == "" {
+			config.ConnName = c.Config.ConnName
+		}
+		if config.Driver == "" {
+			config.Driver = c.Config.Driver
+		}
+
+		replica := NewConnection(&config)
+		if _, err := replica.Open(); err != nil {
+			c.closeReplicas()
+			return err
+		}
+		c.replicas = append(c.replicas, replica)
+	}
+
+	if c.Config.Balancer != nil {
+		c.balancer = c.Config.Balancer
+	} else {
+		c.balancer = &RoundRobinBalancer{}
+	}
+
+	return nil
+}
+
+// closeReplicas closes and forgets all the replica connections
+func (c *Connection) closeReplicas() error {
+	var firstErr error
+	for _, replica := range c.replicas {
+		if err := replica.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	c.replicas = nil
+	return firstErr
+}
+
+// Replicas returns the read replica connections of the connection
+func (c *Connection) Replicas() []*Connection {
+	return c.replicas
+}
+
+// InFlight returns the number of read queries currently running on the connection
+func (c *Connection) InFlight() int64 {
+	return c.inFlight.Load()
+}
+
+// reader returns the connection that should serve a read query for the given context
+func (c *Connection) reader(ctx context.Context) *Connection {
+	if len(c.replicas) == 0 {
+		return c
+	}
+
+	if c.Config.Sticky {
+		if state, ok := ctx.Value(stickyKey{}).(*stickyState); ok {
+			state.mutex.Lock()
+			written := state.written[c]
+			state.mutex.Unlock()
+			if written {
+				return c
+			}
+		}
+	}
+
+	return c.balancer.Pick(c.replicas)
+}
+
+// markWritten records a write on the connection in the sticky state of the context
+func (c *Connection) markWritten(ctx context.Context) {
+	if !c.Config.Sticky {
+		return
+	}
+
+	if state, ok := ctx.Value(stickyKey{}).(*stickyState); ok {
+		state.mutex.Lock()
+		state.written[c] = true
+		state.mutex.Unlock()
+	}
+}
@@ -0,0 +1,249 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/huandu/go-sqlbuilder"
+)
+
+// relationTags are the field tags marking struct fields that hold related
+// models rather than columns of the table.
+var relationTags = []string{"hasOne", "hasMany", "belongsTo", "belongsToMany"}
+
+// TableNamer can be implemented by models to override the derived table name.
+type TableNamer interface {
+	TableName() string
+}
+
+// Repo is a typed repository for the table backing the struct type T.
+//
+// The table name is the snake cased plural of the type name unless T
+// implements TableNamer. Columns come from the `db` struct tags and the
+// primary key is the field tagged with `fieldtag:"pk"`, falling back to "id".
+type Repo[T any] struct {
+	conn       *Connection
+	table      string
+	primaryKey string
+	columns    []string
+	model      *sqlbuilder.Struct
+	conditions []ConditionFunc
+}
+
+// NewRepo creates a new Repo for T on the specified connection
+func NewRepo[T any](connName ...string) *Repo[T] {
+	return RepoFromConn[T](Get(connName...))
+}
+
+// RepoFromConn creates a new Repo for T on an existing connection
+func RepoFromConn[T any](conn *Connection) *Repo[T] {
+	var value T
+	model := sqlbuilder.NewStruct(value).
+		For(GetFlavorForDialect(conn.Config.Driver)).
+		WithoutTag(relationTags...)
+
+	primaryKey := "id"
+	if pks := model.WithTag("pk").Columns(); len(pks) > 0 {
+		primaryKey = pks[0]
+	}
+
+	return &Repo[T]{
+		conn:       conn,
+		table:      tableNameOf(value),
+		primaryKey: primaryKey,
+		columns:    model.Columns(),
+		model:      model,
+	}
+}
+
+// tableNameOf derives the table name of a model value
+func tableNameOf(value any) string {
+	if namer, ok := value.(TableNamer); ok {
+		return namer.TableName()
+	}
+	if namer, ok := reflect.New(reflect.TypeOf(value)).Interface().(TableNamer); ok {
+		return namer.TableName()
+	}
+	return pluralize(sqlbuilder.SnakeCaseMapper(reflect.TypeOf(value).Name()))
+}
+
+// pluralize returns the plural form of a snake cased English noun
+func pluralize(name string) string {
+	switch {
+	case strings.HasSuffix(name, "y") && !strings.HasSuffix(name, "ay") &&
+		!strings.HasSuffix(name, "ey") && !strings.HasSuffix(name, "oy"):
+		return strings.TrimSuffix(name, "y") + "ies"
+	case strings.HasSuffix(name, "s"), strings.HasSuffix(name, "x"),
+		strings.HasSuffix(name, "ch"), strings.HasSuffix(name, "sh"):
+		return name + "es"
+	default:
+		return name + "s"
+	}
+}
+
+// Table returns the table name of the repository
+func (r *Repo[T]) Table() string {
+	return r.table
+}
+
+// PrimaryKey returns the primary key column of the repository
+func (r *Repo[T]) PrimaryKey() string {
+	return r.primaryKey
+}
+
+// Columns returns the columns of the repository
+func (r *Repo[T]) Columns() []string {
+	return r.columns
+}
+
+// Where returns a copy of the repository scoped by the given conditions
+func (r *Repo[T]) Where(conditions ...ConditionFunc) *Repo[T] {
+	scoped := *r
+	scoped.conditions = append(append([]ConditionFunc{}, r.conditions...), conditions...)
+	return &scoped
+}
+
+// query returns a QueryBuilder selecting the given columns with the repository conditions applied
+func (r *Repo[T]) query(columns ...string) *QueryBuilder {
+	return QueryFromConn(r.conn).Table(r.table).Select(columns...).Where(r.conditions...)
+}
+
+// Find returns the row with the given primary key.
+// It returns sql.ErrNoRows if there is no such row.
+func (r *Repo[T]) Find(ctx context.Context, id any) (*T, error) {
+	var entity T
+	err := r.query(r.columns...).Where(EQ(r.primaryKey, id)).Limit(1).Scan(ctx, &entity)
+	if err != nil {
+		return nil, err
+	}
+	return &entity, nil
+}
+
+// First returns the first row ordered by primary key.
+// It returns sql.ErrNoRows if there is no such row.
+func (r *Repo[T]) First(ctx context.Context) (*T, error) {
+	var entity T
+	err := r.query(r.columns...).OrderBy(r.primaryKey).Limit(1).Scan(ctx, &entity)
+	if err != nil {
+		return nil, err
+	}
+	return &entity, nil
+}
+
+// All returns all the rows ordered by primary key
+func (r *Repo[T]) All(ctx context.Context) ([]T, error) {
+	entities := []T{}
+	err := r.query(r.columns...).OrderBy(r.primaryKey).ScanAll(ctx, &entities)
+	if err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+// Count returns the number of rows
+func (r *Repo[T]) Count(ctx context.Context) (int64, error) {
+	var count int64
+	err := r.query("COUNT(*)").Scan(ctx, &count)
+	return count, err
+}
+
+// Exists returns true if there is at least one row
+func (r *Repo[T]) Exists(ctx context.Context) (bool, error) {
+	var found []int
+	err := r.query("1").Limit(1).ScanAll(ctx, &found)
+	return len(found) > 0, err
+}
+
+// Create inserts the entity. A zero primary key is left to the database and
+// filled in from the last insert ID, or returned by the INSERT on PostgreSQL
+// and SQL Server, which have no last insert ID.
+func (r *Repo[T]) Create(ctx context.Context, entity *T) error {
+	pk := r.primaryKeyField(entity)
+	generated := pk.IsValid() && pk.IsZero()
+	columns, values := r.columnValues(entity, generated)
+
+	insert := QueryFromConn(r.conn).Table(r.table).Insert(columns, [][]any{values})
+	if driver := r.conn.Config.Driver; generated && (driver == DialectPgSQL || driver == DialectMsSQL) {
+		return insert.Returning(r.primaryKey).Scan(ctx, pk.Addr().Interface())
+	}
+
+	result, err := insert.Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	if generated {
+		if id, err := result.LastInsertId(); err == nil {
+			setInt(pk, id)
+		}
+	}
+
+	return nil
+}
+
+// Update updates all the columns of the entity by its primary key
+func (r *Repo[T]) Update(ctx context.Context, entity *T) error {
+	pk := r.primaryKeyField(entity)
+	if !pk.IsValid() || pk.IsZero() {
+		return errors.New("cannot update an entity without a primary key")
+	}
+
+	columns, values := r.columnValues(entity, true)
+	updatables := make(map[string]any, len(columns))
+	for i, column := range columns {
+		updatables[column] = values[i]
+	}
+
+	_, err := QueryFromConn(r.conn).Table(r.table).
+		Update(updatables).
+		Where(r.conditions...).
+		Where(EQ(r.primaryKey, pk.Interface())).
+		Exec(ctx)
+	return err
+}
+
+// Delete deletes the row with the given primary key
+func (r *Repo[T]) Delete(ctx context.Context, id any) error {
+	_, err := QueryFromConn(r.conn).Table(r.table).
+		Delete().
+		Where(r.conditions...).
+		Where(EQ(r.primaryKey, id)).
+		Exec(ctx)
+	return err
+}
+
+// primaryKeyField returns the primary key field of the entity
+func (r *Repo[T]) primaryKeyField(entity *T) reflect.Value {
+	addrs := r.model.AddrWithCols([]string{r.primaryKey}, entity)
+	if len(addrs) == 0 {
+		return reflect.Value{}
+	}
+	return reflect.ValueOf(addrs[0]).Elem()
+}
+
+// columnValues returns the columns and values of the entity, optionally without the primary key
+func (r *Repo[T]) columnValues(entity *T, skipPrimaryKey bool) ([]string, []any) {
+	values := r.model.Values(entity)
+	columns := make([]string, 0, len(r.columns))
+	result := make([]any, 0, len(values))
+	for i, column := range r.columns {
+		if skipPrimaryKey && column == r.primaryKey {
+			continue
+		}
+		columns = append(columns, column)
+		result = append(result, values[i])
+	}
+	return columns, result
+}
+
+// setInt assigns an integer to an integer field
+func setInt(field reflect.Value, value int64) {
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		field.SetInt(value)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		field.SetUint(uint64(value))
+	}
+}
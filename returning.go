@@ -0,0 +1,143 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/huandu/go-sqlbuilder"
+)
+
+// ErrReturningNotSupported is returned when the rows of an UPDATE or DELETE
+// are requested on a dialect that cannot return them.
+var ErrReturningNotSupported = errors.New("returning rows of an UPDATE or DELETE is not supported by the dialect")
+
+// Returning sets the columns returned by an INSERT, UPDATE or DELETE query,
+// to be read with Scan or ScanAll instead of Exec.
+//
+// It renders as RETURNING on PostgreSQL and SQLite and as OUTPUT INSERTED or
+// OUTPUT DELETED on SQL Server. MySQL has no such clause, so inserted rows are
+// selected back by their auto-increment column, starting from the last
+// insert ID and stepping by @@auto_increment_increment. This also requires
+// that the rows are inserted in a single statement, that is without
+// OnConflict, and that the keys of the statement are consecutive: with
+// innodb_autoinc_lock_mode = 2 concurrent inserts may interleave their keys,
+// and rows inserted by other sessions would then be selected back too.
+func (qb *QueryBuilder) Returning(columns ...string) *QueryBuilder {
+	qb = qb.mutable()
+	qb.returning = quoteColumns(qb.Flavor(), columns)
+	return qb
+}
+
+// ReturningKey sets the auto-increment column by which the rows inserted with
+// Returning are selected back on MySQL. It defaults to id.
+func (qb *QueryBuilder) ReturningKey(column string) *QueryBuilder {
+	qb = qb.mutable()
+	qb.returningKey = quoteColumn(qb.Flavor(), column)
+	return qb
+}
+
+// returningClause returns the RETURNING clause ending the query, if any
+func (qb *QueryBuilder) returningClause() string {
+	if len(qb.returning) == 0 {
+		return ""
+	}
+	switch qb.conn.Config.Driver {
+	case DialectPgSQL, DialectSQLite:
+		return " RETURNING " + strings.Join(qb.returning, ", ")
+	default:
+		return ""
+	}
+}
+
+// outputClause returns the OUTPUT clause of the query on SQL Server, if any.
+// prefix is INSERTED or DELETED.
+func (qb *QueryBuilder) outputClause(prefix string) string {
+	if len(qb.returning) == 0 || qb.conn.Config.Driver != DialectMsSQL {
+		return ""
+	}
+
+	columns := make([]string, len(qb.returning))
+	for i, column := range qb.returning {
+		if strings.Contains(column, ".") {
+			columns[i] = column
+		} else {
+			columns[i] = prefix + "." + column
+		}
+	}
+	return "OUTPUT " + strings.Join(columns, ", ")
+}
+
+// outputInsertQuery builds an INSERT statement with an OUTPUT clause on SQL Server
+func (qb *QueryBuilder) outputInsertQuery() (string, []any) {
+	args := &sqlbuilder.Args{Flavor: sqlbuilder.SQLServer}
+	query := "INSERT INTO " + qb.tableName +
+		" (" + strings.Join(qb.insertColumns, ", ") + ") " +
+		qb.outputClause("INSERTED") +
+		" VALUES " + valuesList(args, qb.insertValues)
+	return args.Compile(query)
+}
+
+// emulatesReturning returns true if the rows of the query have to be read
+// back after running it, because the dialect cannot return them.
+func (qb *QueryBuilder) emulatesReturning() bool {
+	return len(qb.returning) > 0 && qb.queryType != "SELECT" && qb.conn.Config.Driver == DialectMySQL
+}
+
+// insertAndSelect runs an INSERT query and selects the inserted rows into
+// dest by their auto-increment keys, for dialects without RETURNING.
+// one is true when a single row is scanned.
+//
+// The keys are derived from the last insert ID, which is the key of the first
+// row, and the auto-increment step of the session. They are only those of the
+// inserted rows if the server allocated them in one run, see Returning.
+func (qb *QueryBuilder) insertAndSelect(ctx context.Context, dest interface{}, one bool) error {
+	if qb.queryType != "INSERT" || qb.upsert != nil {
+		return ErrReturningNotSupported
+	}
+
+	query, args := qb.Build()
+	result, err := qb.exec(ctx, query, args)
+	if err != nil {
+		return err
+	}
+	first, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	key := qb.returningKey
+	if key == "" {
+		key = "id"
+	}
+
+	reselect := &QueryBuilder{
+		conn:      qb.conn,
+		tableName: qb.tableName,
+		debug:     qb.debug,
+		limit:     -1,
+		offset:    -1,
+		onPrimary: true,
+		tx:        qb.tx,
+	}
+
+	// The keys of the rows are apart by the auto-increment step, which is
+	// above one with multi-primary replication
+	var step int64
+	if err := reselect.get(ctx, &step, "SELECT @@auto_increment_increment", nil); err != nil {
+		return err
+	}
+	keys := make([]any, len(qb.insertValues))
+	for i := range keys {
+		keys[i] = first + int64(i)*step
+	}
+
+	reselect.Select(qb.returning...).
+		Where(In(key, keys...)).
+		OrderBy(key)
+
+	if one {
+		return reselect.Limit(1).Scan(ctx, dest)
+	}
+	return reselect.ScanAll(ctx, dest)
+}
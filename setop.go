@@ -0,0 +1,107 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/huandu/go-sqlbuilder"
+)
+
+// ErrSetOperationNotSupported is returned when running a query combined with
+// a set operation the dialect does not support.
+var ErrSetOperationNotSupported = errors.New("set operation is not supported by the dialect")
+
+// setOp is a SELECT query combined with the query by a set operation
+type setOp struct {
+	op    string
+	query *QueryBuilder
+}
+
+// Union combines the query with the SELECT queries, keeping the distinct
+// rows of all of them.
+//
+// Conditions, joins and groups added to the query apply to its own SELECT,
+// while ORDER BY, LIMIT and OFFSET apply to the combined rows, as do the
+// selected columns of ScanAll and the aggregates:
+//
+//	admins := db.Query().Table("admins").Select("name", "email")
+//	db.Query().Table("users").Select("name", "email").Where(db.EQ("active", true)).
+//		Union(admins).OrderBy("name").Limit(10)
+//
+// The combined queries are parenthesized, so they may have their own ORDER BY
+// and LIMIT, except on SQLite, which does not allow it: the query then fails
+// with ErrSetOperationNotSupported.
+func (qb *QueryBuilder) Union(queries ...*QueryBuilder) *QueryBuilder {
+	return qb.combine("UNION", queries)
+}
+
+// UnionAll combines the query with the SELECT queries, keeping all the rows
+// of all of them, duplicates included. See Union.
+func (qb *QueryBuilder) UnionAll(queries ...*QueryBuilder) *QueryBuilder {
+	return qb.combine("UNION ALL", queries)
+}
+
+// Intersect combines the query with the SELECT queries, keeping the distinct
+// rows found in all of them. See Union.
+//
+// INTERSECT is only available since MySQL 8.0.31, so the query fails with
+// ErrSetOperationNotSupported on MySQL unless Config.ServerVersion is at
+// least 8.0.31.
+func (qb *QueryBuilder) Intersect(queries ...*QueryBuilder) *QueryBuilder {
+	return qb.combine("INTERSECT", queries)
+}
+
+// Except combines the query with the SELECT queries, keeping the distinct
+// rows of the query found in none of them. See Union.
+//
+// EXCEPT is only available since MySQL 8.0.31, so the query fails with
+// ErrSetOperationNotSupported on MySQL unless Config.ServerVersion is at
+// least 8.0.31.
+func (qb *QueryBuilder) Except(queries ...*QueryBuilder) *QueryBuilder {
+	return qb.combine("EXCEPT", queries)
+}
+
+// combine adds the SELECT queries to the query with the set operation op
+func (qb *QueryBuilder) combine(op string, queries []*QueryBuilder) *QueryBuilder {
+	qb = qb.mutable()
+	if (op == "INTERSECT" || op == "EXCEPT") && qb.conn.Config.Driver == DialectMySQL && !qb.conn.Config.serverAtLeast(8, 0, 31) {
+		qb.err = fmt.Errorf("%w: %s on %s", ErrSetOperationNotSupported, op, qb.conn.Config.Driver)
+		return qb
+	}
+
+	qb.ensureSelect()
+	for _, query := range queries {
+		if qb.conn.Config.Driver == DialectSQLite && (len(query.orderBy) > 0 || query.limit >= 0 || query.offset >= 0) {
+			qb.err = fmt.Errorf("%w: %s of a query with ORDER BY, LIMIT or OFFSET on %s", ErrSetOperationNotSupported, op, qb.conn.Config.Driver)
+			return qb
+		}
+		qb.setOps = append(qb.setOps, setOp{op: op, query: query.Clone()})
+	}
+	return qb
+}
+
+// combined returns the SELECT queries combined by the set operations of the
+// query, to be selected from as a derived table. The ORDER BY, LIMIT, OFFSET
+// and WITH clause of the query are left to the query selecting from it.
+func (qb *QueryBuilder) combined() sqlbuilder.Builder {
+	base := qb.withoutCTEs()
+	base.setOps = nil
+	var columns []string
+	if !qb.hasSelection() {
+		columns = []string{"*"}
+	}
+
+	member := "(%v)"
+	if qb.conn.Config.Driver == DialectSQLite {
+		member = "%v"
+	}
+
+	format := []string{member}
+	args := []any{base.selectBuilder(columns, false)}
+	for _, op := range qb.setOps {
+		format = append(format, op.op, member)
+		args = append(args, op.query)
+	}
+	return sqlbuilder.Buildf(strings.Join(format, " "), args...)
+}
@@ -11,7 +11,7 @@ func NewSQLiteConnection(config *Config) *SQLiteConnection {
 }
 
 func (c *SQLiteConnection) Connect() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", c.config.DSN())
+	db, err := sql.Open(c.config.SQLDriverName(), c.config.DSN())
 	if err != nil {
 		return nil, err
 	}
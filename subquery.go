@@ -0,0 +1,98 @@
+package db
+
+import (
+	"github.com/huandu/go-sqlbuilder"
+)
+
+// derivedTable is a subquery the query selects from
+type derivedTable struct {
+	query *QueryBuilder
+	alias string
+}
+
+// clause sets the derived table as the FROM clause of a SELECT builder
+func (t *derivedTable) clause(b Builder) {
+	sb := b.(*BuilderSelect)
+	sb.From(sb.BuilderAs(t.query, t.alias))
+}
+
+// subqueryExpr is a subquery selected as a column
+type subqueryExpr struct {
+	query *QueryBuilder
+	alias string
+}
+
+// build returns the SQL of the subquery column, binding its arguments
+func (e subqueryExpr) build(qb *QueryBuilder, b Builder) string {
+	return "(" + b.(Cond).Var(e.query) + ") AS " + e.alias
+}
+
+// FromSub selects from the SELECT query sub, as a derived table with the
+// given alias, instead of a table.
+//
+//	totals := db.Query().Table("orders").Select("user_id", "SUM(amount) AS total").GroupBy("user_id")
+//	db.Query().FromSub(totals, "totals").Select("AVG(total)")
+func (qb *QueryBuilder) FromSub(sub *QueryBuilder, alias string) *QueryBuilder {
+	qb = qb.mutable()
+	qb.ensureSelect()
+	qb.tableName = ""
+	qb.fromSub = &derivedTable{query: sub.Clone(), alias: alias}
+	qb.addClause(qb.fromSub.clause)
+	return qb
+}
+
+// SelectSub adds the SELECT query sub, which should return a single value,
+// to the selected columns under the given alias.
+//
+//	posts := db.Query().Table("posts").Select("COUNT(*)").Where(db.On("posts.user_id", "=", "users.id"))
+//	db.Query().Table("users").Select("users.name").SelectSub(posts, "posts")
+func (qb *QueryBuilder) SelectSub(sub *QueryBuilder, alias string) *QueryBuilder {
+	qb = qb.mutable()
+	qb.ensureSelect()
+	qb.selectColumns = append(qb.selectColumns, subqueryExpr{query: sub.Clone(), alias: alias})
+	return qb
+}
+
+// BuildWithFlavor builds the query as a SELECT query with the given flavor,
+// numbering its placeholders after the initial arguments. It makes a
+// QueryBuilder a sqlbuilder.Builder, so that it can be passed as a subquery
+// to In, NotIn, Exists, NotExists, Any and All, and nested in other queries.
+func (qb *QueryBuilder) BuildWithFlavor(flavor sqlbuilder.Flavor, initialArg ...any) (string, []any) {
+	return qb.subquery().BuildWithFlavor(flavor, initialArg...)
+}
+
+// Flavor returns the flavor of the dialect of the connection
+func (qb *QueryBuilder) Flavor() sqlbuilder.Flavor {
+	return GetFlavorForDialect(qb.conn.Config.Driver)
+}
+
+// subquery returns a new builder of the SELECT query, to be nested in
+// another query, which binds its arguments.
+func (qb *QueryBuilder) subquery() sqlbuilder.Builder {
+	c := qb.Clone()
+	c.immutable = false
+	c.ensureSelect()
+	return c.selectBuilder(nil, true)
+}
+
+// hasSelection returns true if the query selects columns
+func (qb *QueryBuilder) hasSelection() bool {
+	return len(qb.selectColumns) > 0
+}
+
+// subqueries replaces the QueryBuilders among the values by copies of them,
+// so that changing them afterwards does not change the conditions they are
+// used in.
+func subqueries(values []any) []any {
+	copied := false
+	for i, value := range values {
+		if sub, ok := value.(*QueryBuilder); ok {
+			if !copied {
+				values = append([]any(nil), values...)
+				copied = true
+			}
+			values[i] = sub.Clone()
+		}
+	}
+	return values
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the tracer and the meter of the package
+const instrumentationName = "github.com/lemmego/db"
+
+// Telemetry configures the OpenTelemetry instrumentation of a connection.
+// Nil providers default to the global providers of the otel package.
+type Telemetry struct {
+	TracerProvider trace.TracerProvider
+	MeterProvider  metric.MeterProvider
+}
+
+// telemetry holds the instruments of an instrumented connection
+type telemetry struct {
+	tracer       trace.Tracer
+	duration     metric.Float64Histogram
+	registration metric.Registration
+	attrs        []attribute.KeyValue
+}
+
+// Instrument enables OpenTelemetry tracing and metrics on the connection.
+//
+// Every statement run through a QueryBuilder and every transaction begin,
+// commit and rollback gets a span and is recorded in the
+// db.client.operation.duration histogram. The sql.DBStats of the connection
+// and its replicas are reported as db.client.connections.* gauges.
+func (c *Connection) Instrument(config Telemetry) error {
+	tracerProvider := config.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+	meterProvider := config.MeterProvider
+	if meterProvider == nil {
+		meterProvider = otel.GetMeterProvider()
+	}
+	meter := meterProvider.Meter(instrumentationName)
+
+	t := &telemetry{
+		tracer: tracerProvider.Tracer(instrumentationName),
+		attrs:  []attribute.KeyValue{dbSystem(c.Config.Driver), semconv.DBName(c.Config.Database)},
+	}
+
+	var err error
+	t.duration, err = meter.Float64Histogram("db.client.operation.duration",
+		metric.WithDescription("Duration of database client operations"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return err
+	}
+
+	usage, err := meter.Int64ObservableGauge("db.client.connections.usage",
+		metric.WithDescription("The number of connections that are currently in the state described by the state attribute"),
+		metric.WithUnit("{connection}"))
+	if err != nil {
+		return err
+	}
+	maxOpen, err := meter.Int64ObservableGauge("db.client.connections.max",
+		metric.WithDescription("The maximum number of open connections allowed"),
+		metric.WithUnit("{connection}"))
+	if err != nil {
+		return err
+	}
+	waitCount, err := meter.Int64ObservableGauge("db.client.connections.wait_count",
+		metric.WithDescription("The total number of connections waited for"),
+		metric.WithUnit("{connection}"))
+	if err != nil {
+		return err
+	}
+	waitTime, err := meter.Float64ObservableGauge("db.client.connections.wait_time",
+		metric.WithDescription("The total time blocked waiting for a new connection"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return err
+	}
+
+	t.registration, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		pools := map[string]*Connection{c.Config.ConnName: c}
+		for i, replica := range c.replicas {
+			pools[fmt.Sprintf("%s.replica%d", c.Config.ConnName, i)] = replica
+		}
+
+		for name, pool := range pools {
+			stats := pool.PoolStats()
+			attrs := append([]attribute.KeyValue{attribute.String("pool.name", name)}, t.attrs...)
+			set := metric.WithAttributes(attrs...)
+
+			o.ObserveInt64(usage, int64(stats.Idle), metric.WithAttributes(append(attrs, attribute.String("state", "idle"))...))
+			o.ObserveInt64(usage, int64(stats.InUse), metric.WithAttributes(append(attrs, attribute.String("state", "used"))...))
+			o.ObserveInt64(maxOpen, int64(stats.MaxOpenConnections), set)
+			o.ObserveInt64(waitCount, stats.WaitCount, set)
+			o.ObserveFloat64(waitTime, stats.WaitDuration.Seconds(), set)
+		}
+		return nil
+	}, usage, maxOpen, waitCount, waitTime)
+	if err != nil {
+		return err
+	}
+
+	if c.telemetry != nil {
+		_ = c.telemetry.registration.Unregister()
+	}
+	c.telemetry = t
+	return nil
+}
+
+// dbSystem returns the db.system attribute of the dialect
+func dbSystem(dialect string) attribute.KeyValue {
+	switch dialect {
+	case DialectSQLite:
+		return semconv.DBSystemSqlite
+	case DialectMySQL:
+		return semconv.DBSystemMySQL
+	case DialectPgSQL:
+		return semconv.DBSystemPostgreSQL
+	case DialectMsSQL:
+		return semconv.DBSystemMSSQL
+	default:
+		return semconv.DBSystemKey.String(dialect)
+	}
+}
+
+// startSpan starts the span of a database operation on an instrumented
+// connection. The returned function ends the span and records the duration
+// of the operation; it must be called with the outcome of the operation.
+func (c *Connection) startSpan(ctx context.Context, operation, table, statement string) (context.Context, func(err error)) {
+	t := c.telemetry
+	if t == nil {
+		return ctx, func(error) {}
+	}
+
+	name := operation
+	attrs := append([]attribute.KeyValue{semconv.DBOperation(operation)}, t.attrs...)
+	if table != "" {
+		name += " " + table
+		attrs = append(attrs, semconv.DBSQLTable(table))
+	}
+
+	start := time.Now()
+	ctx, span := t.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	if statement != "" {
+		span.SetAttributes(semconv.DBStatement(statement))
+	}
+
+	return ctx, func(err error) {
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			attrs = append(attrs, semconv.ErrorTypeKey.String(fmt.Sprintf("%T", err)))
+		}
+		span.End()
+		t.duration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(attrs...))
+	}
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Tx is a transaction handle bound to a connection.
+// Transactions begun from an open Tx are backed by savepoints.
+type Tx struct {
+	*sqlx.Tx
+	conn      *Connection
+	savepoint string
+	depth     int
+	done      bool
+	// ctx is the context the transaction was begun with, parenting the
+	// spans of its commit or rollback
+	ctx context.Context
+}
+
+// txKey is the context key of the transaction of a connection
+type txKey struct {
+	conn *Connection
+}
+
+// WithTx returns a context carrying the given transaction.
+// Queries run with this context on the transaction's connection join the transaction.
+func WithTx(ctx context.Context, tx *Tx) context.Context {
+	return context.WithValue(ctx, txKey{conn: tx.conn}, tx)
+}
+
+// TxFromContext returns the open transaction of the connection carried by the context
+func TxFromContext(ctx context.Context, conn *Connection) (*Tx, bool) {
+	tx, ok := ctx.Value(txKey{conn: conn}).(*Tx)
+	if !ok || tx.done {
+		return nil, false
+	}
+	return tx, true
+}
+
+// Begin starts a nested transaction by creating a savepoint
+func (tx *Tx) Begin(ctx context.Context) (*Tx, error) {
+	if tx.done {
+		return nil, sql.ErrTxDone
+	}
+
+	name := fmt.Sprintf("sp_%d", tx.depth+1)
+	_, end := tx.conn.startSpan(ctx, "SAVEPOINT", "", "")
+	_, err := tx.Tx.ExecContext(ctx, savepointSQL(tx.conn.Config.Driver, name))
+	end(err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tx{Tx: tx.Tx, conn: tx.conn, savepoint: name, depth: tx.depth + 1, ctx: ctx}, nil
+}
+
+// Commit commits the transaction, or releases its savepoint if it is nested
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+
+	if tx.savepoint == "" {
+		_, end := tx.conn.startSpan(tx.context(), "COMMIT", "", "")
+		err := tx.Tx.Commit()
+		end(err)
+		return err
+	}
+
+	query := releaseSavepointSQL(tx.conn.Config.Driver, tx.savepoint)
+	if query == "" {
+		return nil
+	}
+	_, end := tx.conn.startSpan(tx.context(), "RELEASE SAVEPOINT", "", "")
+	_, err := tx.Tx.Exec(query)
+	end(err)
+	return err
+}
+
+// Rollback rolls back the transaction, or the work done since its savepoint if it is nested
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+
+	if tx.savepoint == "" {
+		_, end := tx.conn.startSpan(tx.context(), "ROLLBACK", "", "")
+		err := tx.Tx.Rollback()
+		end(err)
+		return err
+	}
+
+	_, end := tx.conn.startSpan(tx.context(), "ROLLBACK TO SAVEPOINT", "", "")
+	_, err := tx.Tx.Exec(rollbackToSavepointSQL(tx.conn.Config.Driver, tx.savepoint))
+	end(err)
+	return err
+}
+
+// context returns the context the transaction was begun with
+func (tx *Tx) context() context.Context {
+	if tx.ctx == nil {
+		return context.Background()
+	}
+	return tx.ctx
+}
+
+// Nested returns true if the transaction is backed by a savepoint
+func (tx *Tx) Nested() bool {
+	return tx.savepoint != ""
+}
+
+// finish commits the transaction when err is nil and rolls it back otherwise.
+// A panic rolls the transaction back and is re-thrown.
+func (tx *Tx) finish(err *error) {
+	if p := recover(); p != nil {
+		_ = tx.Rollback()
+		panic(p)
+	} else if *err != nil {
+		_ = tx.Rollback()
+	} else {
+		*err = tx.Commit()
+	}
+}
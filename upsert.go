@@ -0,0 +1,167 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/huandu/go-sqlbuilder"
+)
+
+// upsert is the conflict handling of an INSERT query
+type upsert struct {
+	keys    []string
+	update  bool
+	columns []string
+}
+
+// OnConflict makes the INSERT query an upsert on conflicts over the given
+// unique key columns. It must be followed by DoUpdate or DoNothing.
+//
+// MySQL ignores the keys and handles conflicts on any unique index, while
+// SQL Server requires them to match the inserted rows with MERGE. PostgreSQL
+// and SQLite only accept DoNothing without keys.
+func (qb *QueryBuilder) OnConflict(keys ...string) *QueryBuilder {
+	qb = qb.mutable()
+	qb.upsert = &upsert{keys: quoteColumns(qb.Flavor(), keys)}
+	return qb
+}
+
+// DoUpdate updates the given columns of the conflicting rows with the
+// inserted values. Without columns, all the inserted columns but the
+// conflict keys are updated.
+func (qb *QueryBuilder) DoUpdate(columns ...string) *QueryBuilder {
+	qb = qb.mutable()
+	if qb.upsert == nil {
+		qb.upsert = &upsert{}
+	}
+	qb.upsert.update = true
+	qb.upsert.columns = quoteColumns(qb.Flavor(), columns)
+	return qb
+}
+
+// DoNothing keeps the conflicting rows as they are
+func (qb *QueryBuilder) DoNothing() *QueryBuilder {
+	qb = qb.mutable()
+	if qb.upsert == nil {
+		qb.upsert = &upsert{}
+	}
+	qb.upsert.update = false
+	qb.upsert.columns = nil
+	return qb
+}
+
+// updateColumns returns the columns to update on conflict
+func (u *upsert) updateColumns(insertColumns []string) []string {
+	if len(u.columns) > 0 {
+		return u.columns
+	}
+
+	columns := make([]string, 0, len(insertColumns))
+	for _, column := range insertColumns {
+		if !slices.Contains(u.keys, column) {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// validate returns an error if the upsert cannot be built for the dialect
+func (u *upsert) validate(dialect string, insertColumns []string) error {
+	if len(insertColumns) == 0 {
+		return errors.New("upsert requires the columns to insert")
+	}
+	if dialect == DialectMsSQL && len(u.keys) == 0 {
+		return errors.New("upsert on mssql requires conflict keys to match the rows with MERGE")
+	}
+	if (dialect == DialectPgSQL || dialect == DialectSQLite) && u.update && len(u.keys) == 0 {
+		return errors.New("upsert on " + dialect + " requires conflict keys to update the conflicting rows")
+	}
+	return nil
+}
+
+// clause returns the conflict clause following the VALUES of the INSERT query
+func (u *upsert) clause(dialect string, insertColumns []string) string {
+	columns := u.updateColumns(insertColumns)
+
+	if dialect == DialectMySQL {
+		assignments := make([]string, len(columns))
+		for i, column := range columns {
+			assignments[i] = column + " = VALUES(" + column + ")"
+		}
+		if !u.update || len(assignments) == 0 {
+			// Assigning a key to itself leaves the row untouched
+			noop := insertColumns[0]
+			if len(u.keys) > 0 {
+				noop = u.keys[0]
+			}
+			assignments = []string{noop + " = " + noop}
+		}
+		return "ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ", ")
+	}
+
+	clause := "ON CONFLICT"
+	if len(u.keys) > 0 {
+		clause += " (" + strings.Join(u.keys, ", ") + ")"
+	}
+	if !u.update || len(columns) == 0 {
+		return clause + " DO NOTHING"
+	}
+
+	assignments := make([]string, len(columns))
+	for i, column := range columns {
+		assignments[i] = column + " = EXCLUDED." + column
+	}
+	return clause + " DO UPDATE SET " + strings.Join(assignments, ", ")
+}
+
+// mergeQuery builds the MERGE statement standing for an upsert on SQL Server
+func (qb *QueryBuilder) mergeQuery() (string, []any) {
+	args := &sqlbuilder.Args{Flavor: sqlbuilder.SQLServer}
+
+	on := make([]string, len(qb.upsert.keys))
+	for i, key := range qb.upsert.keys {
+		on[i] = "target." + key + " = source." + key
+	}
+
+	sourceColumns := make([]string, len(qb.insertColumns))
+	for i, column := range qb.insertColumns {
+		sourceColumns[i] = "source." + column
+	}
+
+	var buf strings.Builder
+	buf.WriteString("MERGE INTO " + qb.tableName + " WITH (HOLDLOCK) AS target")
+	buf.WriteString(" USING (VALUES " + valuesList(args, qb.insertValues) + ")")
+	buf.WriteString(" AS source (" + strings.Join(qb.insertColumns, ", ") + ")")
+	buf.WriteString(" ON " + strings.Join(on, " AND "))
+
+	if columns := qb.upsert.updateColumns(qb.insertColumns); qb.upsert.update && len(columns) > 0 {
+		assignments := make([]string, len(columns))
+		for i, column := range columns {
+			assignments[i] = "target." + column + " = source." + column
+		}
+		buf.WriteString(" WHEN MATCHED THEN UPDATE SET " + strings.Join(assignments, ", "))
+	}
+
+	buf.WriteString(" WHEN NOT MATCHED THEN INSERT (" + strings.Join(qb.insertColumns, ", ") + ")")
+	buf.WriteString(" VALUES (" + strings.Join(sourceColumns, ", ") + ")")
+	if output := qb.outputClause("INSERTED"); output != "" {
+		buf.WriteString(" " + output)
+	}
+	buf.WriteString(";")
+
+	return args.Compile(buf.String())
+}
+
+// valuesList returns the rows of a VALUES list, adding their values to args
+func valuesList(args *sqlbuilder.Args, rows [][]any) string {
+	list := make([]string, len(rows))
+	for i, row := range rows {
+		placeholders := make([]string, len(row))
+		for j, value := range row {
+			placeholders[j] = args.Add(value)
+		}
+		list[i] = "(" + strings.Join(placeholders, ", ") + ")"
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,329 @@
+package db
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/huandu/go-sqlbuilder"
+)
+
+// Frame bounds of Rows and Range
+const (
+	UnboundedPreceding = "UNBOUNDED PRECEDING"
+	CurrentRow         = "CURRENT ROW"
+	UnboundedFollowing = "UNBOUNDED FOLLOWING"
+)
+
+// Preceding returns the frame bound n rows before the current row
+func Preceding(n int) string {
+	return strconv.Itoa(n) + " PRECEDING"
+}
+
+// Following returns the frame bound n rows after the current row
+func Following(n int) string {
+	return strconv.Itoa(n) + " FOLLOWING"
+}
+
+// WindowSpec is the window of a window function: how the rows are
+// partitioned, how each partition is ordered, and the frame of rows around
+// the current one. Its methods return a changed copy.
+type WindowSpec struct {
+	partitionBy []string
+	orderBy     []string
+	frame       string
+}
+
+// Window returns a window covering all the rows of the query
+//
+//	db.Window().PartitionBy("department").OrderBy("salary DESC")
+func Window() WindowSpec {
+	return WindowSpec{}
+}
+
+// PartitionBy adds columns to the PARTITION BY of the window
+func (w WindowSpec) PartitionBy(columns ...string) WindowSpec {
+	w.partitionBy = append(slices.Clip(w.partitionBy), columns...)
+	return w
+}
+
+// OrderBy adds columns, each optionally followed by ASC or DESC, to the
+// ORDER BY of the window.
+func (w WindowSpec) OrderBy(columns ...string) WindowSpec {
+	w.orderBy = append(slices.Clip(w.orderBy), columns...)
+	return w
+}
+
+// Rows sets the frame of the window to the rows between start and end, like
+// UnboundedPreceding and CurrentRow for a running total.
+func (w WindowSpec) Rows(start, end string) WindowSpec {
+	w.frame = "ROWS BETWEEN " + start + " AND " + end
+	return w
+}
+
+// Range sets the frame of the window to the rows whose ORDER BY value is
+// between start and end.
+func (w WindowSpec) Range(start, end string) WindowSpec {
+	w.frame = "RANGE BETWEEN " + start + " AND " + end
+	return w
+}
+
+// String returns the SQL of the window, without parentheses
+func (w WindowSpec) String() string {
+	parts := make([]string, 0, 3)
+	if len(w.partitionBy) > 0 {
+		parts = append(parts, "PARTITION BY "+strings.Join(w.partitionBy, ", "))
+	}
+	if len(w.orderBy) > 0 {
+		parts = append(parts, "ORDER BY "+strings.Join(w.orderBy, ", "))
+	}
+	if w.frame != "" {
+		parts = append(parts, w.frame)
+	}
+	return strings.Join(parts, " ")
+}
+
+// quoted returns the window with the names of its columns quoted for the
+// flavor. ORDER BY expressions are kept as they are.
+func (w WindowSpec) quoted(flavor sqlbuilder.Flavor) WindowSpec {
+	w.partitionBy = quoteColumns(flavor, w.partitionBy)
+	orderBy := make([]string, len(w.orderBy))
+	for i, column := range w.orderBy {
+		orderBy[i], _ = quoteOrder(flavor, column)
+	}
+	w.orderBy = orderBy
+	return w
+}
+
+// namedWindow is a window defined in the WINDOW clause of the query
+type namedWindow struct {
+	name string
+	spec WindowSpec
+}
+
+// WindowFunc is a call of a window function over a window, to be passed to
+// SelectExpr or OrderByExpr:
+//
+//	db.Query().Table("employees").SelectExpr("name", "department",
+//		db.RowNumber().Over(db.Window().PartitionBy("department").OrderBy("salary DESC")).As("rank"))
+type WindowFunc struct {
+	fn         string
+	args       []string
+	values     []any
+	ordered    bool
+	window     WindowSpec
+	windowName string
+	alias      string
+}
+
+// RowNumber returns the ROW_NUMBER() window function, numbering the rows of
+// each partition from 1.
+func RowNumber() WindowFunc {
+	return WindowFunc{fn: "ROW_NUMBER", ordered: true}
+}
+
+// Rank returns the RANK() window function, ranking the rows of each
+// partition with gaps after ties.
+func Rank() WindowFunc {
+	return WindowFunc{fn: "RANK", ordered: true}
+}
+
+// DenseRank returns the DENSE_RANK() window function, ranking the rows of
+// each partition without gaps after ties.
+func DenseRank() WindowFunc {
+	return WindowFunc{fn: "DENSE_RANK", ordered: true}
+}
+
+// NTile returns the NTILE(buckets) window function, dividing the rows of
+// each partition into buckets numbered from 1.
+func NTile(buckets int) WindowFunc {
+	return WindowFunc{fn: "NTILE", args: []string{strconv.Itoa(buckets)}, ordered: true}
+}
+
+// Lag returns the LAG window function, the value of the column offset rows
+// before the current row. The optional default value, bound as an argument,
+// is returned when there is no such row, instead of NULL.
+func Lag(column string, offset int, defaultValue ...any) WindowFunc {
+	return WindowFunc{fn: "LAG", args: []string{column, strconv.Itoa(offset)}, values: defaultValue, ordered: true}
+}
+
+// Lead returns the LEAD window function, the value of the column offset rows
+// after the current row. The optional default value, bound as an argument,
+// is returned when there is no such row, instead of NULL.
+func Lead(column string, offset int, defaultValue ...any) WindowFunc {
+	return WindowFunc{fn: "LEAD", args: []string{column, strconv.Itoa(offset)}, values: defaultValue, ordered: true}
+}
+
+// FirstValue returns the FIRST_VALUE window function, the value of the
+// column in the first row of the frame.
+func FirstValue(column string) WindowFunc {
+	return WindowFunc{fn: "FIRST_VALUE", args: []string{column}}
+}
+
+// LastValue returns the LAST_VALUE window function, the value of the column
+// in the last row of the frame.
+func LastValue(column string) WindowFunc {
+	return WindowFunc{fn: "LAST_VALUE", args: []string{column}}
+}
+
+// SumOver returns the SUM window function, a running total when the window
+// is ordered. The aggregate of the whole query is QueryBuilder.Sum.
+func SumOver(column string) WindowFunc {
+	return WindowFunc{fn: "SUM", args: []string{column}}
+}
+
+// AvgOver returns the AVG window function
+func AvgOver(column string) WindowFunc {
+	return WindowFunc{fn: "AVG", args: []string{column}}
+}
+
+// CountOver returns the COUNT window function
+func CountOver(column string) WindowFunc {
+	return WindowFunc{fn: "COUNT", args: []string{column}}
+}
+
+// MinOver returns the MIN window function
+func MinOver(column string) WindowFunc {
+	return WindowFunc{fn: "MIN", args: []string{column}}
+}
+
+// MaxOver returns the MAX window function
+func MaxOver(column string) WindowFunc {
+	return WindowFunc{fn: "MAX", args: []string{column}}
+}
+
+// Over sets the window of the function. Without a window, the function is
+// computed over all the rows of the query.
+func (f WindowFunc) Over(w WindowSpec) WindowFunc {
+	f.window = w
+	f.windowName = ""
+	return f
+}
+
+// OverWindow sets the window of the function to a window defined by the
+// query with Window.
+func (f WindowFunc) OverWindow(name string) WindowFunc {
+	f.window = WindowSpec{}
+	f.windowName = name
+	return f
+}
+
+// As sets the alias of the selected function
+func (f WindowFunc) As(alias string) WindowFunc {
+	f.alias = alias
+	return f
+}
+
+// build returns the SQL of the function call. SQL Server, which has no
+// WINDOW clause, gets named windows inlined, and requires an ORDER BY for
+// ranking and offset functions.
+func (f WindowFunc) build(qb *QueryBuilder, b Builder) string {
+	mssql := qb.conn.Config.Driver == DialectMsSQL
+
+	args := slices.Clone(f.args)
+	if len(args) > 0 {
+		args[0] = quoteColumn(qb.Flavor(), args[0])
+	}
+	if f.fn == "AVG" && mssql {
+		args[0] = floatColumn(args[0])
+	}
+	for _, value := range f.values {
+		args = append(args, b.(Cond).Var(value))
+	}
+
+	w, name := f.window, f.windowName
+	if spec, ok := qb.namedWindow(name); ok && mssql {
+		w, name = spec, ""
+	}
+
+	over := name
+	if name == "" {
+		if mssql && f.ordered && len(w.orderBy) == 0 {
+			w = w.OrderBy("(SELECT NULL)")
+		}
+		over = "(" + w.quoted(qb.Flavor()).String() + ")"
+	}
+
+	sql := f.fn + "(" + strings.Join(args, ", ") + ") OVER " + over
+	if f.alias != "" {
+		sql += " AS " + f.alias
+	}
+	return sql
+}
+
+// Window defines a named window in the WINDOW clause of the query, to be
+// shared by window functions with OverWindow:
+//
+//	db.Query().Table("payments").
+//		SelectExpr("id", db.SumOver("amount").OverWindow("w").As("total"), db.CountOver("*").OverWindow("w").As("count")).
+//		Window("w", db.Window().PartitionBy("user_id").OrderBy("paid_at"))
+//
+// SQL Server has no WINDOW clause, so the window is written in place of its
+// name in the OVER clauses instead.
+func (qb *QueryBuilder) Window(name string, w WindowSpec) *QueryBuilder {
+	qb = qb.mutable()
+	qb.windows = append(qb.windows, namedWindow{name: name, spec: w})
+	return qb
+}
+
+// namedWindow returns the window defined by the query with the given name
+func (qb *QueryBuilder) namedWindow(name string) (WindowSpec, bool) {
+	for _, w := range qb.windows {
+		if w.name == name {
+			return w.spec, true
+		}
+	}
+	return WindowSpec{}, false
+}
+
+// windowClause returns the WINDOW clause of the query, if the dialect has one
+func (qb *QueryBuilder) windowClause() string {
+	if len(qb.windows) == 0 || qb.conn.Config.Driver == DialectMsSQL {
+		return ""
+	}
+
+	windows := make([]string, len(qb.windows))
+	for i, w := range qb.windows {
+		windows[i] = w.name + " AS (" + w.spec.quoted(qb.Flavor()).String() + ")"
+	}
+	return "WINDOW " + strings.Join(windows, ", ")
+}
+
+// windowSelect is a SELECT query with a WINDOW clause, which the SELECT
+// builder cannot write. The clause is inserted between the query without
+// ORDER BY, LIMIT and OFFSET, and the rest of it.
+type windowSelect struct {
+	head   *sqlbuilder.SelectBuilder
+	query  *sqlbuilder.SelectBuilder
+	clause string
+}
+
+// withWindow returns the SELECT query with the WINDOW clause, if any, where
+// head is the query without ORDER BY, LIMIT and OFFSET.
+func withWindow(head, query *sqlbuilder.SelectBuilder, clause string) sqlbuilder.Builder {
+	if clause == "" {
+		return query
+	}
+	return &windowSelect{head: head, query: query, clause: clause}
+}
+
+// Build returns the SQL and the arguments of the query
+func (w *windowSelect) Build() (string, []any) {
+	return w.BuildWithFlavor(w.query.Flavor())
+}
+
+// BuildWithFlavor builds the query with the given flavor, numbering its
+// placeholders after the initial arguments.
+func (w *windowSelect) BuildWithFlavor(flavor sqlbuilder.Flavor, initialArg ...any) (string, []any) {
+	query, args := w.query.BuildWithFlavor(flavor, initialArg...)
+	head, _ := w.head.BuildWithFlavor(flavor, initialArg...)
+	if !strings.HasPrefix(query, head) {
+		return query, args
+	}
+	return head + " " + w.clause + query[len(head):], args
+}
+
+// Flavor returns the flavor of the query
+func (w *windowSelect) Flavor() sqlbuilder.Flavor {
+	return w.query.Flavor()
+}